@@ -44,6 +44,7 @@ type cache struct {
 	items             map[string]Item
 	mu                sync.RWMutex
 	onEvicted         func(string, interface{})
+	onExpired         func(string, interface{})
 	janitor           *janitor
 }
 
@@ -931,9 +932,10 @@ type keyAndValue struct {
 
 // Delete all expired items from the cache.
 func (c *cache) DeleteExpired() {
-	var evictedItems []keyAndValue
+	var evictedItems, expiredItems []keyAndValue
 	now := time.Now().UnixNano()
 	c.mu.Lock()
+	onExpired := c.onExpired
 	for k, v := range c.items {
 		// "Inlining" of expired
 		if v.Expiration > 0 && now > v.Expiration {
@@ -941,12 +943,18 @@ func (c *cache) DeleteExpired() {
 			if evicted {
 				evictedItems = append(evictedItems, keyAndValue{k, ov})
 			}
+			if onExpired != nil {
+				expiredItems = append(expiredItems, keyAndValue{k, v.Object})
+			}
 		}
 	}
 	c.mu.Unlock()
 	for _, v := range evictedItems {
 		c.onEvicted(v.key, v.value)
 	}
+	for _, v := range expiredItems {
+		onExpired(v.key, v.value)
+	}
 }
 
 // Sets an (optional) function that is called with the key and value when an
@@ -958,6 +966,15 @@ func (c *cache) OnEvicted(f func(string, interface{})) {
 	c.mu.Unlock()
 }
 
+// Sets an (optional) function that is called with the key and value when an
+// expired item is removed by DeleteExpired. Unlike OnEvicted it is not called
+// for items deleted manually. Set to nil to disable.
+func (c *cache) OnExpired(f func(string, interface{})) {
+	c.mu.Lock()
+	c.onExpired = f
+	c.mu.Unlock()
+}
+
 // Write the cache's items (using Gob) to an io.Writer.
 //
 // NOTE: This method is deprecated in favor of c.Items() and NewFrom() (see the
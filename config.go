@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"net"
+	"os"
 	"strings"
 	"time"
 	//	  "github.com/gdexlab/go-render/render"
@@ -13,6 +13,13 @@ import (
 
 type InvalidAddress int64
 
+// Minutes is a time interval set in minutes
+type Minutes int64
+
+func (m Minutes) Duration() time.Duration {
+	return time.Duration(m) * time.Minute
+}
+
 const (
 	IgnoreInvalidAddress  InvalidAddress = 0
 	ProcessInvalidAddress                = 1
@@ -20,20 +27,151 @@ const (
 )
 
 type Config struct {
-	Listen     string            `yaml:"listen"`
-	Prefix     string            `yaml:"prefix"`
-	MeshPrefix string            `yaml:"mesh-prefix"`
-	Forwarders map[string]string `yaml:"forwarders"`
-	Default    string            `yaml:"default"`
-	IA         InvalidAddress    `yaml:"invalid-address"`
-	Static     map[string]string `yaml:"static"`
-	Cache      struct {
-		ExpTime   time.Duration `yaml:"expiration"`
-		PurgeTime time.Duration `yaml:"purge"`
+	Listen      string `yaml:"listen"`
+	ListenUDP   string `yaml:"listen-udp"`
+	ListenTCP   string `yaml:"listen-tcp"`
+	ListenTLS   string `yaml:"listen-tls"`
+	ListenHTTPS string `yaml:"listen-https"`
+	TLS         struct {
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	} `yaml:"tls"`
+	Prefix      string                 `yaml:"prefix"`
+	Prefixes    []PrefixRule           `yaml:"prefixes"`
+	MeshPrefix  string                 `yaml:"mesh-prefix"`
+	Forwarders  map[string]Upstreams   `yaml:"forwarders"`
+	Default     Upstreams              `yaml:"default"`
+	Upstream    UpstreamConfig         `yaml:"upstream"`
+	IA          InvalidAddress         `yaml:"invalid-address"`
+	Static      map[string]StaticEntry `yaml:"static"`
+	StaticFiles []StaticFile           `yaml:"static-files"`
+	Cache       struct {
+		ExpTime   Minutes `yaml:"expiration"`
+		PurgeTime Minutes `yaml:"purge"`
 	} `yaml:"cache"`
-	LogLevel   string `yaml:"log-level"`
-	StrictIPv6 bool   `yaml:"strict-ipv6"`
-	FallBack   bool   `yaml:"allow-fallback-aaaa"`
+	Pool struct {
+		Range  string  `yaml:"range"`
+		Lease  Minutes `yaml:"lease"`
+		Export string  `yaml:"export"`
+	} `yaml:"pool"`
+	PTR struct {
+		ForwardNames bool    `yaml:"forward-names"`
+		Expiration   Minutes `yaml:"expiration"`
+		Fallback     string  `yaml:"fallback"`
+	} `yaml:"ptr"`
+	TTL struct {
+		Min      uint32 `yaml:"min"`
+		Max      uint32 `yaml:"max"`
+		Negative uint32 `yaml:"negative"`
+	} `yaml:"ttl"`
+	RateLimit struct {
+		Rate       float64 `yaml:"rate"`
+		Burst      float64 `yaml:"burst"`
+		IPv4Prefix int     `yaml:"ipv4-prefix"`
+		IPv6Prefix int     `yaml:"ipv6-prefix"`
+		Slip       uint32  `yaml:"slip"`
+	} `yaml:"rate-limit"`
+	ACL struct {
+		Allow []string `yaml:"allow"`
+		Deny  []string `yaml:"deny"`
+	} `yaml:"acl"`
+	Views      []View            `yaml:"views"`
+	Metrics    string            `yaml:"metrics"`
+	WatchCfg   bool              `yaml:"watch-config"`
+	QueryLog   QueryLogConfig    `yaml:"query-log"`
+	LogLevel   string            `yaml:"log-level"`
+	LogFormat  string            `yaml:"log-format"`
+	LogLevels  map[string]string `yaml:"log-levels"`
+	LogAPI     bool              `yaml:"log-level-endpoint"`
+	StrictIPv6 bool              `yaml:"strict-ipv6"`
+	FallBack   bool              `yaml:"allow-fallback-aaaa"`
+}
+
+// Per-query log. Sink is one of stdout, file or syslog
+type QueryLogConfig struct {
+	Sink       string            `yaml:"sink"`
+	File       string            `yaml:"file"`
+	MaxSize    int64             `yaml:"max-size"`
+	MaxBackups int               `yaml:"max-backups"`
+	Syslog     string            `yaml:"syslog"`
+	Sample     float64           `yaml:"sample"`
+	Redact     map[string]string `yaml:"redact"`
+	HashKey    string            `yaml:"hash-key,omitempty"`
+}
+
+// Upstreams is a route to one or more upstream servers. In config it is
+// written as "host:port", a list of servers or a mapping with strategy.
+type Upstreams struct {
+	Strategy string           `yaml:"strategy,omitempty"`
+	Servers  []UpstreamServer `yaml:"servers"`
+}
+
+// UpstreamServer is "host:port", "tls://host:port", "https://host/path"
+// or a mapping with own timeout, TLS and HTTP settings
+type UpstreamServer struct {
+	Address    string        `yaml:"address"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+	ServerName string        `yaml:"server-name,omitempty"`
+	SPKI       []string      `yaml:"spki,omitempty"`
+	CAFile     string        `yaml:"ca-file,omitempty"`
+	Method     string        `yaml:"method,omitempty"`
+}
+
+// StaticEntry is records of a static name. In config it is written as
+// an address, a list of addresses or a mapping of record types.
+// IPv4 addresses are translated, IPv6 ones are returned as is.
+type StaticEntry struct {
+	TTL   uint32     `yaml:"ttl,omitempty"`
+	A     stringList `yaml:"a,omitempty"`
+	AAAA  stringList `yaml:"aaaa,omitempty"`
+	CNAME string     `yaml:"cname,omitempty"`
+	TXT   stringList `yaml:"txt,omitempty"`
+	MX    stringList `yaml:"mx,omitempty"`
+	SRV   stringList `yaml:"srv,omitempty"`
+}
+
+// StaticFile is a hosts file or a master zone file with static records.
+// In config it is written as path of a hosts file or a mapping.
+type StaticFile struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format,omitempty"`
+	Origin string `yaml:"origin,omitempty"`
+}
+
+// stringList is a list of strings, single one may be written as a scalar
+type stringList []string
+
+// Health checking and defaults of upstream servers
+type UpstreamConfig struct {
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxFails    int           `yaml:"max-fails"`
+	EjectTime   time.Duration `yaml:"eject-time"`
+	HealthCheck time.Duration `yaml:"health-check"`
+	ProbeName   string        `yaml:"probe-name"`
+	Connections int           `yaml:"connections"`
+	IdleTimeout time.Duration `yaml:"idle-timeout"`
+}
+
+// View overrides settings for clients from listed networks.
+// Omitted settings are inherited from the top level.
+type View struct {
+	Name        string                 `yaml:"name"`
+	Clients     []string               `yaml:"clients"`
+	Forwarders  map[string]Upstreams   `yaml:"forwarders"`
+	Default     Upstreams              `yaml:"default"`
+	Static      map[string]StaticEntry `yaml:"static"`
+	StaticFiles []StaticFile           `yaml:"static-files"`
+	StrictIPv6  *bool                  `yaml:"strict-ipv6"`
+	IA          *InvalidAddress        `yaml:"invalid-address"`
+	Prefix      string                 `yaml:"prefix"`
+	Prefixes    []PrefixRule           `yaml:"prefixes"`
+}
+
+// Translation prefix for destinations under domains or in IPv4 networks
+type PrefixRule struct {
+	Prefix   string   `yaml:"prefix"`
+	Domains  []string `yaml:"domains"`
+	Networks []string `yaml:"networks"`
 }
 
 func (a InvalidAddress) String() string {
@@ -48,6 +186,10 @@ func (a InvalidAddress) String() string {
 	return "Ignore"
 }
 
+func (a InvalidAddress) MarshalYAML() (interface{}, error) {
+	return strings.ToLower(a.String()), nil
+}
+
 func (ia *InvalidAddress) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
 	var IA string
 
@@ -70,15 +212,144 @@ func (ia *InvalidAddress) UnmarshalYAML(unmarshal func(interface{}) error) (err
 	return nil
 }
 
-func InitConfig() (Config, error) {
+// Types without custom (un)marshaling
+type (
+	upstreamsRoute Upstreams
+	upstreamServer UpstreamServer
+	staticEntry    StaticEntry
+	staticFile     StaticFile
+)
+
+func (u *Upstreams) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var servers []UpstreamServer
+	if err := unmarshal(&servers); err == nil {
+		*u = Upstreams{Servers: servers}
+		return nil
+	}
+	var server UpstreamServer
+	if err := unmarshal(&server); err == nil && server.Address != "" {
+		*u = Upstreams{Servers: []UpstreamServer{server}}
+		return nil
+	}
+	return unmarshal((*upstreamsRoute)(u))
+}
+
+func (u Upstreams) MarshalYAML() (interface{}, error) {
+	if u.Strategy == "" && len(u.Servers) == 1 {
+		return u.Servers[0].MarshalYAML()
+	}
+	return upstreamsRoute(u), nil
+}
+
+func (s *UpstreamServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&s.Address); err == nil {
+		return nil
+	}
+	return unmarshal((*upstreamServer)(s))
+}
+
+func (s UpstreamServer) MarshalYAML() (interface{}, error) {
+	if s.Timeout == 0 && s.ServerName == "" && len(s.SPKI) == 0 && s.CAFile == "" && s.Method == "" {
+		return s.Address, nil
+	}
+	return upstreamServer(s), nil
+}
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+func (e *StaticEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addrs stringList
+	if err := unmarshal(&addrs); err == nil {
+		*e = StaticEntry{}
+		for _, addr := range addrs {
+			if strings.Contains(addr, ":") {
+				e.AAAA = append(e.AAAA, addr)
+			} else {
+				e.A = append(e.A, addr)
+			}
+		}
+		return nil
+	}
+	return unmarshal((*staticEntry)(e))
+}
+
+func (e StaticEntry) MarshalYAML() (interface{}, error) {
+	if e.TTL != 0 || e.CNAME != "" || len(e.TXT) > 0 || len(e.MX) > 0 || len(e.SRV) > 0 {
+		return staticEntry(e), nil
+	}
+	addrs := append(append([]string(nil), e.A...), e.AAAA...)
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+	return addrs, nil
+}
+
+func (f *StaticFile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&f.Path); err == nil {
+		return nil
+	}
+	return unmarshal((*staticFile)(f))
+}
+
+func (f StaticFile) MarshalYAML() (interface{}, error) {
+	if (f.Format == "" || f.Format == "hosts") && f.Origin == "" {
+		return f.Path, nil
+	}
+	return staticFile(f), nil
+}
+
+// staticFiles returns paths of static files including views
+func (c *Config) staticFiles() (paths []string) {
+	for _, f := range c.StaticFiles {
+		paths = append(paths, f.Path)
+	}
+	for _, v := range c.Views {
+		for _, f := range v.StaticFiles {
+			paths = append(paths, f.Path)
+		}
+	}
+	return
+}
+
+// upstreamServers returns servers of all routes including views
+func (c *Config) upstreamServers() []UpstreamServer {
+	servers := append([]UpstreamServer(nil), c.Default.Servers...)
+	for _, route := range c.Forwarders {
+		servers = append(servers, route.Servers...)
+	}
+	for _, v := range c.Views {
+		servers = append(servers, v.Default.Servers...)
+		for _, route := range v.Forwarders {
+			servers = append(servers, route.Servers...)
+		}
+	}
+	return servers
+}
+
+// InitConfig parses command line and loads config file.
+// File name is returned for reloading.
+// In check mode validates the file, prints effective config and exits.
+func InitConfig() (Config, string, error) {
 	fileName := flag.String("file", "config.yml", "config filename")
+	check := flag.Bool("check-config", false, "validate config, print effective configuration and exit")
 	flag.Parse()
 
+	if *check {
+		os.Exit(checkConfig(*fileName))
+	}
+
 	Configs, err := parseFile(*fileName)
 	if err != nil {
-		return Config{}, err
+		return Config{}, *fileName, err
 	}
-	return *Configs, nil
+	return *Configs, *fileName, nil
 }
 
 func parseFile(filePath string) (*Config, error) {
@@ -91,20 +362,83 @@ func parseFile(filePath string) (*Config, error) {
 	cfg.Cache.ExpTime = 0
 	cfg.Cache.PurgeTime = 0
 	cfg.LogLevel = "info"
+	cfg.LogFormat = "text"
 	cfg.MeshPrefix = "200::/7"
 	cfg.FallBack = false
+	cfg.Pool.Lease = 60
+	cfg.PTR.Expiration = 60
+	cfg.RateLimit.IPv4Prefix = 32
+	cfg.RateLimit.IPv6Prefix = 56
+	cfg.RateLimit.Slip = 2
+	cfg.Upstream.Timeout = 2 * time.Second
+	cfg.Upstream.MaxFails = 3
+	cfg.Upstream.EjectTime = 30 * time.Second
+	cfg.Upstream.HealthCheck = 10 * time.Second
+	cfg.Upstream.ProbeName = "."
+	cfg.Upstream.Connections = 4
+	cfg.Upstream.IdleTimeout = 30 * time.Second
 	if err := yaml.UnmarshalStrict(body, &cfg); err != nil {
 		return nil, err
 	}
 
-	_, yggnet, err = net.ParseCIDR(cfg.MeshPrefix)
-	if err != nil {
+	if cfg.ListenUDP == "" {
+		cfg.ListenUDP = cfg.Listen
+	}
+	if cfg.ListenTCP == "" {
+		cfg.ListenTCP = cfg.Listen
+	}
+
+	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
 
 	return cfg, nil
 }
 
-func (c *Config) validateForwarders() {
+// checkConfig validates config file and prints it with defaults applied.
+// Returns exit code.
+func checkConfig(filePath string) int {
+	cfg, err := parseFile(filePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filePath, err)
+		return 1
+	}
+	body, err := yaml.Marshal(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filePath, err)
+		return 1
+	}
+	fmt.Printf("# %s is valid. Effective configuration:\n%s", filePath, body)
+	return 0
+}
 
+// viewConfig returns the configuration with view settings applied
+func (c *Config) viewConfig(v *View) Config {
+	cfg := *c
+	if v.Forwarders != nil {
+		cfg.Forwarders = v.Forwarders
+	}
+	if len(v.Default.Servers) > 0 {
+		cfg.Default = v.Default
+	}
+	if v.Static != nil {
+		cfg.Static = v.Static
+	}
+	if v.StaticFiles != nil {
+		cfg.StaticFiles = v.StaticFiles
+	}
+	if v.StrictIPv6 != nil {
+		cfg.StrictIPv6 = *v.StrictIPv6
+	}
+	if v.IA != nil {
+		cfg.IA = *v.IA
+	}
+	if v.Prefix != "" {
+		cfg.Prefix = v.Prefix
+		cfg.Prefixes = nil
+	}
+	if v.Prefixes != nil {
+		cfg.Prefixes = v.Prefixes
+	}
+	return cfg
 }
@@ -3,72 +3,204 @@ package main
 import (
 	"github.com/miekg/dns"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 	//    "github.com/gdexlab/go-render/render"
 	"fmt"
 )
 
-var yggnet *net.IPNet
+var metrics = NewMetrics()
 
 type DNSProxy struct {
 	Cache          *Cache
-	static         map[string]string
-	forwarders     map[string]string
-	defaultForward string
-	prefix         net.IP
+	static         *DomainTrie[[]dns.RR]
+	reverse        map[netip.Addr][]dns.RR
+	names          *Cache
+	ptrFallback    string
+	forwarders     *DomainTrie[*UpstreamGroup]
+	defaultForward *UpstreamGroup
+	translator     *Translator
+	pool           *Pool
 	strictIPv6     bool
 	ia             InvalidAddress
 	FallBack       bool
+	minTTL         uint32
+	maxTTL         uint32
+	negativeMaxTTL uint32
+	meshNet        *net.IPNet
+	// effective configuration, compared on reload
+	config *Config
+
+	upstreamLog  *Log
+	cacheLog     *Log
+	translateLog *Log
 }
 
-func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg) (*dns.Msg, error) {
-	responseMsg := new(dns.Msg)
+// NewDNSProxy creates proxy from the configuration. Pool may be nil
+func NewDNSProxy(cfg *Config, pool *Pool, logger *Log) (*DNSProxy, error) {
+	translator, err := NewTranslator(cfg.Prefix, cfg.Prefixes)
+	if err != nil {
+		return nil, fmt.Errorf("wrong prefix format: %w", err)
+	}
+	_, meshNet, err := net.ParseCIDR(cfg.MeshPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("wrong mesh-prefix: %w", err)
+	}
+
+	upstreamLog := logger.Sub("upstream")
+	defaultForward, err := NewUpstreamGroup(cfg.Default, cfg.Upstream, upstreamLog)
+	if err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	forwarders := NewDomainTrie[*UpstreamGroup]()
+	for domain, route := range cfg.Forwarders {
+		group, err := NewUpstreamGroup(route, cfg.Upstream, upstreamLog)
+		if err != nil {
+			return nil, fmt.Errorf("forwarder %s: %w", domain, err)
+		}
+		forwarders.Insert(domain, group)
+	}
+	records, err := loadStaticFiles(cfg.StaticFiles)
+	if err != nil {
+		return nil, fmt.Errorf("static-files: %w", err)
+	}
+	// Inline entries replace records of the same name from files
+	for name, entry := range cfg.Static {
+		rrs, err := entry.records(name)
+		if err != nil {
+			return nil, fmt.Errorf("static %s: %w", name, err)
+		}
+		records[normalizeDomain(name)] = rrs
+	}
+	static := NewDomainTrie[[]dns.RR]()
+	for name, rrs := range records {
+		static.Insert(name, rrs)
+	}
+
+	proxy := &DNSProxy{
+		Cache:          New(cfg.Cache.ExpTime.Duration(), cfg.Cache.PurgeTime.Duration()),
+		forwarders:     forwarders,
+		static:         static,
+		reverse:        staticReverse(records),
+		names:          newNameTable(cfg),
+		ptrFallback:    cfg.PTR.Fallback,
+		translator:     translator,
+		pool:           pool,
+		defaultForward: defaultForward,
+		strictIPv6:     cfg.StrictIPv6,
+		ia:             cfg.IA,
+		FallBack:       cfg.FallBack,
+		minTTL:         cfg.TTL.Min,
+		maxTTL:         cfg.TTL.Max,
+		negativeMaxTTL: cfg.TTL.Negative,
+		meshNet:        meshNet,
+		config:         cfg,
+		upstreamLog:    upstreamLog,
+		cacheLog:       logger.Sub("cache"),
+		translateLog:   logger.Sub("translate"),
+	}
+
+	// Entries deleted on reload or by forgetPTR are not evictions
+	proxy.Cache.OnExpired(func(string, interface{}) {
+		metrics.Cache.Inc("eviction")
+	})
+
+	if pool != nil {
+		// Clients must stop using address before its lease expires
+		if half := uint32(pool.Lease() / time.Second / 2); proxy.maxTTL == 0 || proxy.maxTTL > half {
+			proxy.maxTTL = half
+		}
+	}
+	return proxy, nil
+}
+
+// getResponse builds answer for the request. Forwarder and the way
+// the answer was built are stored into rec.
+func (proxy *DNSProxy) getResponse(requestMsg *dns.Msg, rec *QueryRecord) (*dns.Msg, error) {
 	var answer *dns.Msg
 	var err error
 
-	if len(requestMsg.Question) > 0 {
-		question := requestMsg.Question[0]
-
-		dnsServer := proxy.getForwarder(question.Name)
+	if len(requestMsg.Question) == 0 {
+		answer = new(dns.Msg)
+		answer.SetRcode(requestMsg, dns.RcodeFormatError)
+		return answer, nil
+	}
+	question := requestMsg.Question[0]
 
-		switch question.Qtype {
-		case dns.TypeA:
-			if proxy.strictIPv6 {
-				answer, err = proxy.processTypeA(dnsServer, &question, requestMsg)
-			} else {
-				answer, err = proxy.processOtherTypes(dnsServer, &question, requestMsg)
-			}
+	// Static names are answered before cache, so changes of static
+	// records apply immediately
+	if _, ok := proxy.getStatic(question.Name); ok {
+		rec.Path = PathStatic
+		answer, err = proxy.processStatic(&question, requestMsg)
+		if err != nil {
+			return serverFailure(requestMsg), err
+		}
+		if question.Qtype == dns.TypeAAAA {
+			metrics.AAAAAnswers.Inc(rec.Path)
+		}
+		return answer, nil
+	}
 
-		case dns.TypeAAAA:
-			answer, err = proxy.processTypeAAAA(dnsServer, &question, requestMsg)
+	key := cacheKey(&question, requestMsg)
+	if msg := proxy.getCached(key, requestMsg); msg != nil {
+		rec.Path = PathCache
+		return msg, nil
+	}
 
-		case dns.TypePTR:
-			answer, err = proxy.processTypePTR(dnsServer, &question, requestMsg)
+	upstreams := proxy.getForwarder(question.Name)
+	rec.Forwarder = upstreams.String()
+	rec.Path = PathUpstream
 
-		case dns.TypeANY:
-			answer, err = proxy.processTypeANY(dnsServer, &question, requestMsg)
+	switch question.Qtype {
+	case dns.TypeA:
+		if proxy.strictIPv6 {
+			answer, err = proxy.processTypeA(upstreams, &question, requestMsg)
+		} else {
+			answer, err = proxy.processOtherTypes(upstreams, &question, requestMsg)
+		}
 
-		default:
-			answer, err = proxy.processOtherTypes(dnsServer, &question, requestMsg)
+	case dns.TypeAAAA:
+		answer, err = proxy.processTypeAAAA(upstreams, &question, requestMsg, rec)
+		if err == nil && rec.Path != PathUpstream {
+			metrics.AAAAAnswers.Inc(rec.Path)
 		}
+
+	case dns.TypePTR:
+		answer, err = proxy.processTypePTR(upstreams, &question, requestMsg, rec)
+
+	case dns.TypeANY:
+		answer, err = proxy.processTypeANY(upstreams, &question, requestMsg)
+
+	default:
+		answer, err = proxy.processOtherTypes(upstreams, &question, requestMsg)
 	}
 
+	// Client gets SERVFAIL when no upstream answered
 	if err != nil {
-		return responseMsg, err
+		return serverFailure(requestMsg), err
 	}
 
-	//    answer.MsgHdr.RecursionDesired = true
 	answer.MsgHdr.RecursionAvailable = true
-	return answer, err
+	proxy.setCached(key, answer)
+	return answer, nil
 }
 
-func (proxy *DNSProxy) processOtherTypes(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+// serverFailure builds SERVFAIL answer for the request
+func serverFailure(requestMsg *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetRcode(requestMsg, dns.RcodeServerFailure)
+	answer.RecursionAvailable = true
+	return answer
+}
+
+func (proxy *DNSProxy) processOtherTypes(upstreams *UpstreamGroup, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := upstreams.Exchange(queryMsg)
 	if err != nil {
 		return nil, err
 	}
@@ -77,12 +209,12 @@ func (proxy *DNSProxy) processOtherTypes(dnsServer string, q *dns.Question, requ
 }
 
 // Query ANY
-func (proxy *DNSProxy) processTypeANY(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+func (proxy *DNSProxy) processTypeANY(upstreams *UpstreamGroup, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := upstreams.Exchange(queryMsg)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +243,7 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR) (answer []dns.RR) {
 				}
 			} else {
 				// if answer contains ygg address - return it
-				if yggnet.Contains(rr.AAAA) {
+				if proxy.meshNet.Contains(rr.AAAA) {
 					answer = append(answer, rr)
 				}
 			}
@@ -122,7 +254,7 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR) (answer []dns.RR) {
 					continue
 				case IgnoreInvalidAddress: // return "as-is"
 				case ProcessInvalidAddress: // return "[::]"
-					nrr, _ := dns.NewRR(rr.Hdr.Name + " IN AAAA ::")
+					nrr := proxy.newAAAA(rr.Hdr.Name, netip.IPv6Unspecified(), rr.Hdr.Ttl)
 					answer = append(answer, nrr)
 					if !proxy.strictIPv6 {
 						answer = append(answer, rr)
@@ -130,7 +262,12 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR) (answer []dns.RR) {
 					continue
 				}
 			}
-			nrr, _ := dns.NewRR(rr.Hdr.Name + " IN AAAA " + proxy.MakeFakeIP(rr.A))
+			v4, _ := netip.AddrFromSlice(rr.A)
+			ip, err := proxy.MakeFakeIP(rr.Hdr.Name, v4)
+			if err != nil {
+				continue
+			}
+			nrr := proxy.newAAAA(rr.Hdr.Name, ip, rr.Hdr.Ttl)
 			answer = append(answer, nrr)
 			if !proxy.strictIPv6 {
 				answer = append(answer, rr)
@@ -142,23 +279,45 @@ func (proxy *DNSProxy) processAnswerArray(q []dns.RR) (answer []dns.RR) {
 	return
 }
 
-// Query PTR
-func (proxy *DNSProxy) processTypePTR(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+// Query PTR. Addresses of static records and, if enabled, names of
+// synthesized addresses are answered locally. Other synthesized ones are
+// asked upstream for PTR of IPv4 address, with fallback to generated
+// name. Other reverse names are forwarded as is.
+func (proxy *DNSProxy) processTypePTR(upstreams *UpstreamGroup, q *dns.Question, requestMsg *dns.Msg, rec *QueryRecord) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	//    queryMsg.Question = []dns.Question{*q}
 
+	// Static AAAA addresses are answered as is. IPv4 of static A records
+	// is seen by clients only inside mesh addresses, its own reverse
+	// zone belongs to the upstream.
+	meshIP, err := ReversePTR(q.Name)
+	if err == nil && meshIP.Is6() {
+		if ptrs, ok := proxy.reverse[meshIP]; ok {
+			rec.Path = PathStatic
+			return localPTR(requestMsg, ptrs...), nil
+		}
+	}
+
+	// Not our address, the upstream knows it
 	ip, err := proxy.ReversePTR(q.Name)
 	if err != nil {
-		queryMsg.MsgHdr.Rcode = dns.RcodeNameError
-		queryMsg.MsgHdr.Opcode = dns.OpcodeNotify
-		return queryMsg, nil
+		return proxy.processOtherTypes(upstreams, q, requestMsg)
+	}
+	if ptrs, ok := proxy.reverse[ip]; ok {
+		rec.Path = PathStatic
+		return localPTR(requestMsg, ptrs...), nil
 	}
+	if name, ok := proxy.forwardName(meshIP); ok {
+		rec.Path = PathForwardName
+		return localPTR(requestMsg, newPTR("", name, ptrTTL)), nil
+	}
+
 	origQuestion := requestMsg.Question
 	q.Name, _ = dns.ReverseAddr(ip.String())
 	queryMsg.Question = []dns.Question{*q}
 
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := upstreams.Exchange(queryMsg)
 	if err != nil {
 		return nil, err
 	}
@@ -167,22 +326,30 @@ func (proxy *DNSProxy) processTypePTR(dnsServer string, q *dns.Question, request
 	for _, orr := range msg.Answer {
 		a, okA := orr.(*dns.PTR)
 		if okA {
-			rr, _ := dns.NewRR(origQuestion[0].Name + " IN PTR " + a.Ptr)
+			rr := &dns.PTR{
+				Hdr: dns.RR_Header{Name: origQuestion[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: a.Hdr.Ttl},
+				Ptr: a.Ptr,
+			}
 			answer = append(answer, rr)
 		}
 	}
 	msg.Answer = answer
 	msg.Question[0].Qtype = dns.TypePTR
 	//fmt.Printf("\nPTR %s\n",render.Render(msg))
+
+	if len(answer) == 0 && proxy.ptrFallback != "" {
+		rec.Path = PathGenerated
+		return localPTR(requestMsg, newPTR("", generatedName(proxy.ptrFallback, meshIP, ip), ptrTTL)), nil
+	}
 	return msg, nil
 }
 
 // Query A record. Emulate "no record" for existings A
-func (proxy *DNSProxy) processTypeA(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+func (proxy *DNSProxy) processTypeA(upstreams *UpstreamGroup, q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
 	queryMsg := new(dns.Msg)
 	requestMsg.CopyTo(queryMsg)
 	queryMsg.Question = []dns.Question{*q}
-	msg, err := lookup(dnsServer, queryMsg)
+	msg, err := upstreams.Exchange(queryMsg)
 	if err != nil {
 		queryMsg.MsgHdr.Rcode = dns.RcodeServerFailure
 		queryMsg.MsgHdr.Opcode = dns.OpcodeNotify
@@ -192,134 +359,233 @@ func (proxy *DNSProxy) processTypeA(dnsServer string, q *dns.Question, requestMs
 	return msg, nil
 }
 
-func (proxy *DNSProxy) processTypeAAAA(dnsServer string, q *dns.Question, requestMsg *dns.Msg) (msg *dns.Msg, err error) {
-	msg = new(dns.Msg)
-	cacheAnswer, found := proxy.Cache.Get(q.Name)
+func (proxy *DNSProxy) processTypeAAAA(upstreams *UpstreamGroup, q *dns.Question, requestMsg *dns.Msg, rec *QueryRecord) (msg *dns.Msg, err error) {
+	// Query AAAA address, may be it's already mesh?
 
-	// Have cache record?
+	queryMsg := new(dns.Msg)
+	requestMsg.CopyTo(queryMsg)
+	queryMsg.Question = []dns.Question{*q}
 
-	if !found {
+	msg, err = upstreams.Exchange(queryMsg)
+	if err != nil {
+		return nil, err
+	}
 
-		// No cache.
-		// Have static address?
+	// Name doesn't exist. No need to ask A
+	if msg.Rcode == dns.RcodeNameError {
+		return msg, nil
+	}
 
-		ip := proxy.getStatic(q.Name)
-		if ip != "" {
-			requestMsg.CopyTo(msg)
-			answer := make([]dns.RR, 0)
-			rr, _ := dns.NewRR(q.Name + " IN AAAA " + proxy.MakeFakeIP(net.ParseIP(ip)))
-			answer = append(answer, rr)
-			msg.Answer = answer
-			msg.Question[0].Qtype = dns.TypeAAAA
-			msg.MsgHdr.Response = true
-			proxy.Cache.Set(q.Name, answer, 0)
-			return msg, nil
+	answer := make([]dns.RR, 0)
+	answerv6 := make([]dns.RR, 0)
+
+	for _, orr := range msg.Answer {
+		a, okA := orr.(*dns.AAAA)
+		if okA {
+			if proxy.meshNet.Contains(a.AAAA) {
+				answer = append(answer, orr)
+			}
+			answerv6 = append(answerv6, orr)
 		}
+	}
 
-		// No static.
-		// Query AAAA address, may be it's already mesh?
+	if len(answer) != 0 {
+		msg.Answer = answer
+		msg.MsgHdr.Response = true
+		rec.Path = PathNativeAAAA
+		return msg, nil
+	}
 
-		queryMsg := new(dns.Msg)
-		requestMsg.CopyTo(queryMsg)
-		queryMsg.Question = []dns.Question{*q}
+	// No. Ok, query A address and translate to mesh.
 
-		msg, err = lookup(dnsServer, queryMsg)
-		if err != nil {
-			return nil, err
-		}
+	q.Qtype = dns.TypeA
+	queryMsg = new(dns.Msg)
+	requestMsg.CopyTo(queryMsg)
+	queryMsg.Question = []dns.Question{*q}
+
+	msg, err = upstreams.Exchange(queryMsg)
+	if err != nil {
+		return nil, err
+	}
 
-		answer := make([]dns.RR, 0)
-		answerv6 := make([]dns.RR, 0)
+	// Build fake answer
 
-		for _, orr := range msg.Answer {
-			a, okA := orr.(*dns.AAAA)
-			if okA {
-				if yggnet.Contains(a.AAAA) {
-					answer = append(answer, orr)
+	answer = make([]dns.RR, 0)
+	for _, orr := range msg.Answer {
+		a, okA := orr.(*dns.A)
+		if okA {
+			if a.A.IsUnspecified() {
+				switch proxy.ia {
+				case DiscardInvalidAddress: // drop
+					continue
+				case IgnoreInvalidAddress: // return "as-is"
+				case ProcessInvalidAddress: // return "[::]"
+					nrr := proxy.newAAAA(q.Name, netip.IPv6Unspecified(), a.Hdr.Ttl)
+					answer = append(answer, nrr)
+					continue
 				}
-				answerv6 = append(answerv6, orr)
 			}
+			v4, _ := netip.AddrFromSlice(a.A)
+			fakeIP, err := proxy.MakeFakeIP(q.Name, v4)
+			if err != nil {
+				return nil, err
+			}
+			rr := proxy.newAAAA(q.Name, fakeIP, a.Hdr.Ttl)
+			answer = append(answer, rr)
 		}
+	}
+	msg.Answer = answer
+	msg.Question[0].Qtype = dns.TypeAAAA
+
+	if len(answer) > 0 {
+		rec.Path = PathSynthesized
+	} else if proxy.FallBack && len(answerv6) > 0 {
+		msg.Answer = answerv6
+		//		msg.MsgHdr.Response = true
+		rec.Path = PathFallback
+	}
+	return msg, nil
+}
 
-		if len(answer) != 0 {
-			msg.Answer = answer
-			msg.MsgHdr.Response = true
-			proxy.Cache.Set(q.Name, answer, 0)
-			return msg, nil
-		}
-
-		// No. Ok, query A address and translate to mesh.
+// cacheKey builds a cache key from the question and the request flags
+// that change the answer
+func cacheKey(q *dns.Question, requestMsg *dns.Msg) string {
+	do := false
+	if opt := requestMsg.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return questionKey(q, do, requestMsg.CheckingDisabled)
+}
 
-		q.Qtype = dns.TypeA
-		queryMsg = new(dns.Msg)
-		requestMsg.CopyTo(queryMsg)
-		queryMsg.Question = []dns.Question{*q}
+func questionKey(q *dns.Question, do, cd bool) string {
+	return fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, cd)
+}
 
-		msg, err = lookup(dnsServer, queryMsg)
-		if err != nil {
-			return nil, err
-		}
+type cacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+}
 
-		// Build fake answer
-
-		answer = make([]dns.RR, 0)
-		for _, orr := range msg.Answer {
-			a, okA := orr.(*dns.A)
-			if okA {
-				if a.A.IsUnspecified() {
-					switch proxy.ia {
-					case DiscardInvalidAddress: // drop
-						continue
-					case IgnoreInvalidAddress: // return "as-is"
-					case ProcessInvalidAddress: // return "[::]"
-						nrr, _ := dns.NewRR(q.Name + " IN AAAA ::")
-						answer = append(answer, nrr)
-						continue
-					}
-				}
-				rr, _ := dns.NewRR(q.Name + " IN AAAA " + proxy.MakeFakeIP(a.A))
-				answer = append(answer, rr)
+// getCached returns a copy of cached response adjusted to the request.
+// TTLs are decreased by the time spent in cache.
+func (proxy *DNSProxy) getCached(key string, requestMsg *dns.Msg) *dns.Msg {
+	cached, found := proxy.Cache.Get(key)
+	if !found {
+		metrics.Cache.Inc("miss")
+		proxy.cacheLog.Debug("Cache miss", "key", key)
+		return nil
+	}
+	metrics.Cache.Inc("hit")
+	proxy.cacheLog.Debug("Cache hit", "key", key)
+	entry := cached.(cacheEntry)
+	msg := entry.msg.Copy()
+	msg.Id = requestMsg.Id
+	msg.Question = requestMsg.Question
+
+	elapsed := uint32(time.Since(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
 			}
 		}
-		msg.Answer = answer
-		msg.Question[0].Qtype = dns.TypeAAAA
-
-		if len(answer) > 0 {
-			proxy.Cache.Set(q.Name, answer, 0)
-		} else if proxy.FallBack && len(answerv6) > 0 {
-			msg.Answer = answerv6
-			//			msg.MsgHdr.Response = true
-			proxy.Cache.Set(q.Name, answerv6, 0)
-		}
-		return msg, nil
-	} else {
-
-		// We have cache record
+	}
+	return msg
+}
 
-		requestMsg.CopyTo(msg)
-		msg.Answer = cacheAnswer.([]dns.RR)
-		msg.Question[0].Qtype = dns.TypeAAAA
-		msg.MsgHdr.Response = true
-		return msg, nil
+// setCached stores a copy of response. Entry expires with the smallest
+// TTL in the response, but not later than cache expiration.
+// NXDOMAIN and NODATA are cached for the SOA minimum (RFC 2308),
+// SOA TTL of the response itself is clamped to it as well.
+func (proxy *DNSProxy) setCached(key string, msg *dns.Msg) {
+	if msg == nil || msg.Truncated {
+		return
+	}
+	var ttl uint32
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		ttl = minTTL(msg)
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		ttl = proxy.negativeTTL(msg)
 	}
+	if ttl == 0 {
+		return
+	}
+	exp := time.Duration(ttl) * time.Second
+	if def := proxy.Cache.defaultExpiration; def > 0 && def < exp {
+		exp = def
+	}
+	proxy.Cache.Set(key, cacheEntry{msg: msg.Copy(), stored: time.Now()}, exp)
+	proxy.cacheLog.Debug("Cached", "key", key, "expiration", exp)
 }
 
-func (dnsProxy *DNSProxy) getForwarder(domain string) string {
-	for k, v := range dnsProxy.forwarders {
-		if strings.HasSuffix(strings.ToLower(domain), strings.ToLower(k+".")) {
-			return v
+// negativeTTL returns TTL for NXDOMAIN/NODATA response taken from SOA
+// in authority section. SOA TTL is adjusted to returned value.
+// Without SOA response is not cacheable.
+func (proxy *DNSProxy) negativeTTL(msg *dns.Msg) (ttl uint32) {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if proxy.negativeMaxTTL > 0 && ttl > proxy.negativeMaxTTL {
+			ttl = proxy.negativeMaxTTL
 		}
+		soa.Hdr.Ttl = ttl
+		if len(msg.Answer) > 0 && minTTL(msg) < ttl {
+			ttl = minTTL(msg)
+		}
+		return
 	}
-	return dnsProxy.defaultForward
+	return 0
 }
 
-func (dnsProxy *DNSProxy) getStatic(domain string) string {
-	for k, v := range dnsProxy.static {
-		if strings.ToLower(k+".") == strings.ToLower(domain) {
-			return v
+// minTTL returns the smallest TTL of records in the response
+func minTTL(msg *dns.Msg) (ttl uint32) {
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
 		}
 	}
-	return ""
+	return
+}
+
+// newAAAA builds synthesized AAAA record. TTL is clamped to configured limits
+func (proxy *DNSProxy) newAAAA(name string, ip netip.Addr, ttl uint32) dns.RR {
+	if proxy.maxTTL > 0 && ttl > proxy.maxTTL {
+		ttl = proxy.maxTTL
+	}
+	if ttl < proxy.minTTL {
+		ttl = proxy.minTTL
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+		AAAA: ip.AsSlice(),
+	}
+}
+
+// getForwarder returns upstreams of the most specific forwarder domain
+func (dnsProxy *DNSProxy) getForwarder(domain string) *UpstreamGroup {
+	if group, ok := dnsProxy.forwarders.Match(domain); ok {
+		return group
+	}
+	return dnsProxy.defaultForward
 }
 
 func GetOutboundIP() (net.IP, error) {
@@ -335,87 +601,78 @@ func GetOutboundIP() (net.IP, error) {
 	return localAddr.IP, nil
 }
 
-func lookup(server string, m *dns.Msg) (*dns.Msg, error) {
-	dnsClient := new(dns.Client)
-	dnsClient.Net = "udp"
-	response, _, err := dnsClient.Exchange(m, server)
-	if err != nil {
-		return nil, err
+// MakeFakeIP returns mesh address for IPv4: leased from the pool
+// or built by the translator
+func (proxy *DNSProxy) MakeFakeIP(name string, v4 netip.Addr) (ip netip.Addr, err error) {
+	v4 = v4.Unmap()
+	if proxy.pool != nil {
+		var leased net.IP
+		leased, err = proxy.pool.Get(v4.AsSlice())
+		if err != nil {
+			proxy.translateLog.Warn("Pool allocation failed", "name", name, "ipv4", v4, "err", err)
+			return
+		}
+		ip, _ = netip.AddrFromSlice(leased)
+	} else if ip, err = proxy.translator.Embed(name, v4); err != nil {
+		return
 	}
-
-	return response, nil
-}
-
-func (proxy *DNSProxy) MakeFakeIP(r net.IP) string {
-	ip := proxy.prefix
-	if len(r) == net.IPv6len {
-		ip[15] = r[15]
-		ip[14] = r[14]
-		ip[13] = r[13]
-		ip[12] = r[12]
-	} else {
-		ip[15] = r[3]
-		ip[14] = r[2]
-		ip[13] = r[1]
-		ip[12] = r[0]
-	}
-	return ip.String()
+	proxy.rememberName(name, ip)
+	proxy.translateLog.Debug("Translated", "name", name, "ipv4", v4, "ipv6", ip)
+	return
 }
 
-func ReversePTR(ptr string) (net.IP, error) {
-	var ip net.IP
+// ReversePTR parses address from in-addr.arpa or ip6.arpa name
+func ReversePTR(ptr string) (netip.Addr, error) {
+	ptr = strings.ToLower(ptr)
 	if !strings.HasSuffix(ptr, ".in-addr.arpa.") && !strings.HasSuffix(ptr, ".ip6.arpa.") {
-		return ip, fmt.Errorf("Wrong ptr address in query %s", ptr)
+		return netip.Addr{}, fmt.Errorf("Wrong ptr address in query %s", ptr)
 	}
 	s := strings.Split(ptr, ".")
 	switch len(s) {
 	case 7: // ipv4 in-addr arpa
-		ip = make([]byte, net.IPv4len)
-		for i, j := 0, net.IPv4len-1; i < 4; i, j = i+1, j-1 {
+		var ip [4]byte
+		for i, j := 0, len(ip)-1; i < 4; i, j = i+1, j-1 {
 			a, err := strconv.ParseUint(s[i], 10, 8)
 			if err != nil {
-				return net.IP{}, err
+				return netip.Addr{}, err
 			}
 			ip[j] = byte(a)
 		}
+		return netip.AddrFrom4(ip), nil
 	case 35: // ipv6 ipv6 arpa
-		ip = make([]byte, net.IPv6len)
-		for i, j := 0, net.IPv6len-1; i < 32; i, j = i+2, j-1 {
-			a, err := strconv.ParseUint(s[i], 16, 8)
+		var ip [16]byte
+		for i, j := 0, len(ip)-1; i < 32; i, j = i+2, j-1 {
+			a, err := strconv.ParseUint(s[i], 16, 4)
 			if err != nil {
-				return net.IP{}, err
+				return netip.Addr{}, err
 			}
-			b, err := strconv.ParseUint(s[i+1], 16, 8)
+			b, err := strconv.ParseUint(s[i+1], 16, 4)
 			if err != nil {
-				return net.IP{}, err
+				return netip.Addr{}, err
 			}
 			ip[j] = byte(b)<<4 | byte(a)
 		}
-	default: // wrong length
-		return ip, fmt.Errorf("Wrong PTR in query %s", ptr)
+		return netip.AddrFrom16(ip), nil
 	}
-	return ip, nil
+	return netip.Addr{}, fmt.Errorf("Wrong PTR in query %s", ptr)
 }
 
-func (proxy *DNSProxy) ReversePTR(ptr string) (ipv4 net.IP, err error) {
-	var ip net.IP
-	ip, err = ReversePTR(ptr)
+// ReversePTR returns IPv4 address the mesh address in PTR name was made of
+func (proxy *DNSProxy) ReversePTR(ptr string) (netip.Addr, error) {
+	ip, err := ReversePTR(ptr)
 	if err != nil {
-		return
+		return ip, err
 	}
-	if len(ip) != net.IPv6len {
-		err = fmt.Errorf("PTR is not IPv6")
+	if !ip.Is6() {
+		return netip.Addr{}, fmt.Errorf("PTR is not IPv6")
 	}
-	for i := 0; i < 12; i++ {
-		if ip[i] != proxy.prefix[i] {
-			err = fmt.Errorf("PTR doesn't have our prefix")
-			return
+	if proxy.pool != nil {
+		v4, err := proxy.pool.Lookup(ip.AsSlice())
+		if err != nil {
+			return netip.Addr{}, err
 		}
+		ip, _ = netip.AddrFromSlice(v4.To4())
+		return ip, nil
 	}
-	ipv4 = make([]byte, 4)
-	ipv4[3] = ip[15]
-	ipv4[2] = ip[14]
-	ipv4[1] = ip[13]
-	ipv4[0] = ip[12]
-	return
+	return proxy.translator.Extract(ip)
 }
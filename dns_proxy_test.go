@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testLogger returns logger printing only errors
+func testLogger(tb testing.TB) *Log {
+	tb.Helper()
+	logger, err := NewLogger("error", "text", nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return logger
+}
+
+// Negative answer gets the same SOA TTL as its cached copy
+func TestSetCachedClampsSOA(t *testing.T) {
+	proxy := &DNSProxy{Cache: New(time.Hour, 0), negativeMaxTTL: 60, cacheLog: testLogger(t)}
+	req := query("nx.test.")
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	soa, _ := dns.NewRR("test. 3600 IN SOA ns.test. admin.test. 1 7200 3600 86400 900")
+	resp.Ns = []dns.RR{soa}
+
+	key := cacheKey(&req.Question[0], req)
+	proxy.setCached(key, resp)
+	if ttl := resp.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("response SOA TTL %d, want 60", ttl)
+	}
+	entry, ok := proxy.Cache.Get(key)
+	if !ok {
+		t.Fatal("negative answer not cached")
+	}
+	if ttl := entry.(cacheEntry).msg.Ns[0].Header().Ttl; ttl != 60 {
+		t.Errorf("cached SOA TTL %d, want 60", ttl)
+	}
+}
+
+// Only expired entries count as evictions, not deleted ones
+func TestCacheOnExpired(t *testing.T) {
+	c := New(time.Hour, 0)
+	var expired []string
+	c.OnExpired(func(k string, _ interface{}) { expired = append(expired, k) })
+	c.Set("old", 1, time.Nanosecond)
+	c.Set("deleted", 2, time.Hour)
+	c.Set("fresh", 3, time.Hour)
+	time.Sleep(time.Millisecond)
+
+	c.Delete("deleted")
+	c.DeleteExpired()
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Errorf("expired %q, want [old]", expired)
+	}
+	if _, ok := c.Get("fresh"); !ok {
+		t.Error("fresh entry removed")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+// DNS-over-HTTPS upstream (RFC 8484)
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohMediaType = "application/dns-message"
+
+// httpsTransport sends queries as HTTP POST or GET requests. Connections
+// are kept alive and multiplexed with HTTP/2.
+type httpsTransport struct {
+	url    string
+	get    bool
+	client *http.Client
+}
+
+func newHTTPSTransport(url, hostport string, s UpstreamServer, cfg UpstreamConfig) (*httpsTransport, error) {
+	config, err := upstreamTLSConfig(hostport, s)
+	if err != nil {
+		return nil, err
+	}
+	return &httpsTransport{
+		url: url,
+		get: s.Method == "get",
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:     config,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: cfg.Connections,
+			IdleConnTimeout:     cfg.IdleTimeout,
+		}},
+	}, nil
+}
+
+func (t *httpsTransport) Exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := t.exchange(m, timeout)
+	metrics.ObserveUpstream(t.url, start, err)
+	return resp, err
+}
+
+func (t *httpsTransport) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	// ID 0 makes responses cacheable by HTTP caches
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var req *http.Request
+	if t.get {
+		// Endpoint may have its own query parameters
+		u, _ := url.Parse(t.url)
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		u.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", t.url, httpResp.Status)
+	}
+	ct := httpResp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != dohMediaType {
+		return nil, fmt.Errorf("%s: unexpected content type %q", t.url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	if resp.Id != q.Id {
+		return nil, dns.ErrId
+	}
+	if len(m.Question) > 0 && !answers(resp, m.Question[0]) {
+		return nil, fmt.Errorf("%s: response to another question", t.url)
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// Close closes idle connections
+func (t *httpsTransport) Close() {
+	t.client.CloseIdleConnections()
+}
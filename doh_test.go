@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohTestHandler answers like answerA, query name selects the failure
+func dohTestHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("request over %s", r.Proto)
+		}
+		if r.URL.Query().Get("key") != "secret" {
+			http.Error(w, "no key", http.StatusForbidden)
+			return
+		}
+		var buf []byte
+		var err error
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, err = io.ReadAll(r.Body)
+		}
+		q := new(dns.Msg)
+		if err != nil || q.Unpack(buf) != nil || len(q.Question) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			t.Errorf("query ID %d, want 0", q.Id)
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		contentType := dohMediaType
+		switch q.Question[0].Name {
+		case "status.":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		case "type.":
+			contentType = "text/plain"
+		case "charset.":
+			contentType = dohMediaType + "; charset=utf-8"
+		case "id.":
+			m.Id = 1
+		case "question.":
+			m.Question[0].Name = "other."
+		case "slow.":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		resp, _ := m.Pack()
+		w.Header().Set("Content-Type", contentType)
+		w.Write(resp)
+	}
+}
+
+// startDoHServer runs HTTP/2 server, returns its URL and CA file
+func startDoHServer(t *testing.T) (url, caFile string) {
+	srv := httptest.NewUnstartedServer(dohTestHandler(t))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return srv.URL, caFile
+}
+
+func TestHTTPSTransport(t *testing.T) {
+	url, caFile := startDoHServer(t)
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"a.test.", ""},
+		{"charset.", ""},
+		{"status.", "503 Service Unavailable"},
+		{"type.", `unexpected content type "text/plain"`},
+		{"id.", dns.ErrId.Error()},
+		{"question.", "response to another question"},
+		{"slow.", "deadline exceeded"},
+	}
+	for _, method := range []string{"post", "get"} {
+		s := UpstreamServer{Address: url + "/dns-query?key=secret", CAFile: caFile, Method: method}
+		tr, err := newTransport(s, UpstreamConfig{Connections: 2, IdleTimeout: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			m := query(tt.name)
+			m.Id = 1234
+			resp, err := tr.Exchange(m, 500*time.Millisecond)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("%s %s: %s", method, tt.name, err)
+			case tt.err == "" && (resp.Id != m.Id || len(resp.Answer) != 1):
+				t.Errorf("%s %s: unexpected response %v", method, tt.name, resp)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("%s %s: error %v, want %q", method, tt.name, err, tt.err)
+			}
+		}
+		tr.(*httpsTransport).Close()
+	}
+}
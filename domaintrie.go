@@ -0,0 +1,101 @@
+package main
+
+import "strings"
+
+// normalizeDomain lowercases name and removes leading and trailing dots
+func normalizeDomain(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// inDomain reports whether normalized name is the domain or under it
+func inDomain(name, domain string) bool {
+	return domain == "" || name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// DomainTrie maps domain names to values by labels, from the root down.
+// Names are normalized on insert and on lookup.
+type DomainTrie[V any] struct {
+	root trieNode[V]
+	size int
+}
+
+type trieNode[V any] struct {
+	children map[string]*trieNode[V]
+	value    V
+	set      bool
+}
+
+func NewDomainTrie[V any]() *DomainTrie[V] {
+	return new(DomainTrie[V])
+}
+
+// Insert sets value of the name, replacing the previous one
+func (t *DomainTrie[V]) Insert(name string, value V) {
+	n := &t.root
+	name = normalizeDomain(name)
+	for name != "" {
+		var label string
+		name, label = lastLabel(name)
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode[V])
+			}
+			child = new(trieNode[V])
+			n.children[label] = child
+		}
+		n = child
+	}
+	if !n.set {
+		t.size++
+	}
+	n.value, n.set = value, true
+}
+
+// Get returns value of exactly the name
+func (t *DomainTrie[V]) Get(name string) (value V, ok bool) {
+	n := &t.root
+	name = normalizeDomain(name)
+	for name != "" && n != nil {
+		var label string
+		name, label = lastLabel(name)
+		n = n.children[label]
+	}
+	if n == nil || !n.set {
+		return value, false
+	}
+	return n.value, true
+}
+
+// Match returns value of the most specific domain containing the name
+func (t *DomainTrie[V]) Match(name string) (value V, ok bool) {
+	n := &t.root
+	if n.set {
+		value, ok = n.value, true
+	}
+	name = normalizeDomain(name)
+	for name != "" {
+		var label string
+		name, label = lastLabel(name)
+		if n = n.children[label]; n == nil {
+			break
+		}
+		if n.set {
+			value, ok = n.value, true
+		}
+	}
+	return
+}
+
+// Len returns number of names with values
+func (t *DomainTrie[V]) Len() int {
+	return t.size
+}
+
+// lastLabel splits the rightmost label off the name
+func lastLabel(name string) (rest, label string) {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
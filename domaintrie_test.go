@@ -0,0 +1,115 @@
+package main
+
+import "testing"
+
+func TestDomainTrieMatch(t *testing.T) {
+	trie := NewDomainTrie[string]()
+	trie.Insert(".b", "b")
+	trie.Insert("a.B.", "a.b")
+	trie.Insert("x.a.b", "x.a.b")
+	trie.Insert("ygg", "ygg")
+
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"b", "b", true},
+		{"c.b", "b", true},
+		{"a.b", "a.b", true},
+		{"c.a.b", "a.b", true},
+		{"x.a.b", "x.a.b", true},
+		{"y.x.a.b.", "x.a.b", true},
+		{"C.A.B.", "a.b", true},
+		{".ygg.", "ygg", true},
+		{"xb", "", false},
+		{"a.xb", "", false},
+		{"b.c", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := trie.Match(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Match(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+	if trie.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", trie.Len())
+	}
+}
+
+func TestDomainTrieGet(t *testing.T) {
+	trie := NewDomainTrie[int]()
+	trie.Insert("a.b", 1)
+	trie.Insert("A.B.", 2)
+	trie.Insert("*.b", 3)
+
+	tests := []struct {
+		name string
+		want int
+		ok   bool
+	}{
+		{"a.b", 2, true},
+		{".a.b.", 2, true},
+		{"b", 0, false},
+		{"c.a.b", 0, false},
+		{"*.b", 3, true},
+		{"c.b", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := trie.Get(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Get(%q) = %d, %v; want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", trie.Len())
+	}
+}
+
+// Root domain matches every name
+func TestDomainTrieRoot(t *testing.T) {
+	trie := NewDomainTrie[string]()
+	trie.Insert(".", "root")
+	trie.Insert("b", "b")
+	for name, want := range map[string]string{"a.b.": "b", "c.": "root", ".": "root"} {
+		if got, _ := trie.Match(name); got != want {
+			t.Errorf("Match(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestGetForwarder(t *testing.T) {
+	cfg, err := parseConfig(t, validConfig+`
+forwarders:
+  ".b": 192.0.2.1:53
+  "A.b.": 192.0.2.2:53
+  ygg: 192.0.2.3:53
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewDNSProxy(cfg, nil, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"b.", "192.0.2.1:53"},
+		{"host.b.", "192.0.2.1:53"},
+		{"a.b.", "192.0.2.2:53"},
+		{"host.A.B.", "192.0.2.2:53"},
+		{"host.a.b", "192.0.2.2:53"},
+		{"xb.", "192.0.2.53:53"},
+		{"a.xb.", "192.0.2.53:53"},
+		{"host.ygg.", "192.0.2.3:53"},
+		{"example.com.", "192.0.2.53:53"},
+		{".", "192.0.2.53:53"},
+	}
+	for _, tt := range tests {
+		if got := proxy.getForwarder(tt.name).String(); got != tt.want {
+			t.Errorf("%s: forwarded to %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
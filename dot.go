@@ -0,0 +1,91 @@
+package main
+
+// DNS-over-TLS upstream (RFC 7858)
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tlsTransport sends queries over pooled TLS connections
+type tlsTransport struct {
+	addr string
+	pool *connPool
+}
+
+// newTLSTransport prepares TLS connection settings
+func newTLSTransport(hostport string, s UpstreamServer, cfg UpstreamConfig) (*tlsTransport, error) {
+	config, err := upstreamTLSConfig(hostport, s)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(timeout time.Duration) (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", hostport, config)
+	}
+	return &tlsTransport{addr: hostport, pool: newConnPool(dial, cfg.Connections, 0, cfg.IdleTimeout)}, nil
+}
+
+// upstreamTLSConfig builds client TLS settings of the server. Server name
+// defaults to the host of address. With SPKI pins the certificate chain
+// is not verified, only the pinned key of the server certificate.
+func upstreamTLSConfig(hostport string, s UpstreamServer) (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(hostport)
+	config := &tls.Config{ServerName: s.ServerName, MinVersion: tls.VersionTLS12}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if s.CAFile != "" {
+		pem, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", s.CAFile)
+		}
+	}
+
+	if len(s.SPKI) > 0 {
+		pins := make(map[[sha256.Size]byte]bool)
+		for _, pin := range s.SPKI {
+			b, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("spki %q is not base64 of SHA-256", pin)
+			}
+			pins[[sha256.Size]byte(b)] = true
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no server certificate")
+			}
+			if !pins[sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)] {
+				return errors.New("server key doesn't match spki pins")
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+func (t *tlsTransport) Exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := t.pool.Exchange(m, timeout)
+	metrics.ObserveUpstream("tls://"+t.addr, start, err)
+	return resp, err
+}
+
+// Close closes the connections
+func (t *tlsTransport) Close() {
+	t.pool.Close()
+}
@@ -1,6 +1,6 @@
 module yggdns64
 
-go 1.18
+go 1.21
 
 require (
 	github.com/miekg/dns v1.1.43
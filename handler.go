@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Handler serves client queries: rate limiting, ACL, view selection,
+// proxying and query logging
+type Handler struct {
+	router   atomic.Pointer[Router]
+	limiter  *RateLimiter
+	queryLog *QueryLog
+	logger   *Log
+}
+
+func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	defer metrics.Begin()()
+	clientIP := addrIP(w.RemoteAddr())
+
+	// Only UDP is limited: TCP can't be spoofed and is the fallback
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && h.limiter != nil {
+		switch h.limiter.Check(clientIP) {
+		case RateDrop:
+			return
+		case RateSlip:
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	rec := QueryRecord{Time: time.Now(), Client: clientIP.String()}
+	if len(r.Question) > 0 {
+		rec.Name = r.Question[0].Name
+		rec.Type = dns.TypeToString[r.Question[0].Qtype]
+	}
+
+	var m *dns.Msg
+	dnsProxy := h.router.Load().Select(clientIP)
+	if dnsProxy == nil {
+		m = new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		rec.Path = PathRefused
+	} else {
+		switch r.Opcode {
+		case dns.OpcodeQuery:
+			var err error
+			m, err = dnsProxy.getResponse(r, &rec)
+			if err != nil {
+				h.logger.Error("Failed lookup", "client", rec.Client, "name", rec.Name, "type", rec.Type, "err", err)
+				rec.Error = err.Error()
+			}
+			writeMsg(w, r, m)
+		default:
+			return
+		}
+	}
+
+	metrics.Queries.Inc(rec.Type, dns.RcodeToString[m.Rcode])
+	rec.Rcode = dns.RcodeToString[m.Rcode]
+	rec.Latency = float64(time.Since(rec.Time)) / float64(time.Millisecond)
+	if err := h.queryLog.Log(&rec); err != nil {
+		h.logger.Error("Failed to write query log", "err", err)
+	}
+}
@@ -1,48 +1,198 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-const (
-	infoLevel = 1
-	errLevel  = 2
-)
+// Subsystems with separate log levels
+var logSubsystems = []string{"upstream", "cache", "translate"}
+
+// subLevel follows the root level until it is set explicitly
+type subLevel struct {
+	root *slog.LevelVar
+	own  slog.LevelVar
+	set  atomic.Bool
+}
 
+func (s *subLevel) Level() slog.Level {
+	if s.set.Load() {
+		return s.own.Level()
+	}
+	return s.root.Level()
+}
+
+type logRoot struct {
+	level  slog.LevelVar
+	format string
+	mu     sync.Mutex
+	subs   map[string]*Log
+}
+
+// Log is a leveled structured logger. Subsystem loggers are created
+// with Sub and have their own level.
 type Log struct {
-	level int
+	*slog.Logger
+	root  *logRoot
+	level *subLevel
 }
 
-func NewLogger(logLevel string) *Log {
-	if logLevel == "err" {
-		return &Log{1}
+func newHandler(format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(os.Stderr, opts)
 	}
-	if logLevel == "info" {
-		return &Log{2}
+	return slog.NewTextHandler(os.Stderr, opts)
+}
+
+// NewLogger creates logger writing to stderr. Format is "text" or "json".
+func NewLogger(level, format string, subLevels map[string]string) (*Log, error) {
+	switch format {
+	case "", "text":
+		format = "text"
+	case "json":
+	default:
+		return nil, fmt.Errorf("log-format must be one of 'text/json'")
 	}
 
-	return &Log{0}
+	root := &logRoot{format: format, subs: make(map[string]*Log)}
+	l := &Log{Logger: slog.New(newHandler(format, &root.level)), root: root}
+	if err := l.SetLevel("", level); err != nil {
+		return nil, err
+	}
+	for name, level := range subLevels {
+		if err := l.SetLevel(name, level); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
 }
 
-func (l *Log) Infof(format string, args ...interface{}) {
-	if l.level >= infoLevel {
-		log.SetPrefix("INFO: ")
-		log.SetOutput(os.Stdout)
-		log.Printf(format, args...)
+func parseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error", "err":
+		return slog.LevelError, nil
 	}
+	return 0, fmt.Errorf("log level must be one of 'debug/info/warn/error': %q", level)
 }
 
-func (l *Log) Errorf(format string, args ...interface{}) {
-	if l.level >= errLevel {
-		log.SetPrefix("ERROR: ")
-		log.SetOutput(os.Stderr)
-		log.Printf(format, args...)
+// Sub returns logger of the subsystem
+func (l *Log) Sub(name string) *Log {
+	l.root.mu.Lock()
+	defer l.root.mu.Unlock()
+	if sub, ok := l.root.subs[name]; ok {
+		return sub
+	}
+	level := &subLevel{root: &l.root.level}
+	sub := &Log{
+		Logger: slog.New(newHandler(l.root.format, level)).With("subsystem", name),
+		root:   l.root,
+		level:  level,
 	}
+	l.root.subs[name] = sub
+	return sub
 }
 
-func (l *Log) Fatalf(format string, args ...interface{}) {
-	log.SetPrefix("FATAL: ")
-	log.SetOutput(os.Stderr)
-	log.Fatalf(format, args...)
+// SetLevel changes level of the subsystem, or the root level if name is empty.
+// Subsystems without own level follow the root level.
+func (l *Log) SetLevel(name, level string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		l.root.level.Set(lvl)
+		return nil
+	}
+	known := false
+	for _, s := range logSubsystems {
+		known = known || s == name
+	}
+	if !known {
+		return fmt.Errorf("unknown log subsystem %q", name)
+	}
+	sub := l.Sub(name)
+	sub.level.own.Set(lvl)
+	sub.level.set.Store(true)
+	return nil
+}
+
+// ClearLevel makes the subsystem follow the root level again
+func (l *Log) ClearLevel(name string) {
+	l.Sub(name).level.set.Store(false)
+}
+
+// Levels returns current levels by subsystem. Root level has empty name.
+func (l *Log) Levels() map[string]string {
+	levels := map[string]string{"": l.root.level.Level().String()}
+	for _, name := range logSubsystems {
+		levels[name] = l.Sub(name).level.Level().String()
+	}
+	return levels
+}
+
+// Fatal logs the error and exits
+func (l *Log) Fatal(msg string, args ...any) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+// ServeHTTP shows levels on GET and changes them on POST/PUT:
+// /log-level?level=debug[&subsystem=upstream]
+// Levels are changed only by loopback clients, the endpoint has no auth.
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !isLoopback(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		name, level := r.FormValue("subsystem"), r.FormValue("level")
+		if err := l.SetLevel(name, level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l.Info("Log level changed", "subsystem", name, "level", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	levels := l.Levels()
+	names := make([]string, 0, len(levels))
+	for name := range levels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			fmt.Fprintf(w, "default %s\n", levels[name])
+		} else {
+			fmt.Fprintf(w, "%s %s\n", name, levels[name])
+		}
+	}
+}
+
+// isLoopback checks host:port address of the client
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
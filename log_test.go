@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLogLevelEndpoint(t *testing.T) {
+	tests := []struct {
+		method, remote string
+		code           int
+		level          string
+	}{
+		{http.MethodGet, "192.0.2.1:40000", http.StatusOK, "INFO"},
+		{http.MethodPost, "192.0.2.1:40000", http.StatusForbidden, "INFO"},
+		{http.MethodPut, "[2001:db8::1]:40000", http.StatusForbidden, "INFO"},
+		{http.MethodPost, "127.0.0.1:40000", http.StatusOK, "DEBUG"},
+		{http.MethodPost, "[::1]:40000", http.StatusOK, "DEBUG"},
+		{http.MethodDelete, "127.0.0.1:40000", http.StatusMethodNotAllowed, "INFO"},
+	}
+	for _, tt := range tests {
+		logger, err := NewLogger("info", "text", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(tt.method, "/log-level?subsystem=cache&level=debug", nil)
+		r.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		logger.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s from %s: status %d, want %d", tt.method, tt.remote, w.Code, tt.code)
+		}
+		if level := logger.Levels()["cache"]; level != tt.level {
+			t.Errorf("%s from %s: cache level %s, want %s", tt.method, tt.remote, level, tt.level)
+		}
+	}
+}
@@ -5,49 +5,107 @@ package main
 import (
 	"github.com/miekg/dns"
 	"log"
-	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
-	cfg, err := InitConfig()
+	cfg, cfgFile, err := InitConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configs: %s", err)
 	}
 
-	prefix := net.ParseIP(cfg.Prefix)
-	if len(prefix) != net.IPv6len || prefix.IsUnspecified() {
-		log.Fatalf("Wrong prefix format: %s", cfg.Prefix)
+	logger, err := NewLogger(cfg.LogLevel, cfg.LogFormat, cfg.LogLevels)
+	if err != nil {
+		log.Fatalf("Failed to load configs: %s", err)
+	}
+
+	var pool *Pool
+	if cfg.Pool.Range != "" {
+		pool, err = NewPool(cfg.Pool.Range, cfg.Pool.Lease.Duration(), cfg.Pool.Export)
+		if err != nil {
+			logger.Fatal("Wrong pool", "err", err)
+		}
+		go pool.Run(time.Minute, logger.Sub("translate"))
 	}
 
-	dnsProxy := DNSProxy{
-		Cache:          New(cfg.Cache.ExpTime*time.Minute, cfg.Cache.PurgeTime*time.Minute),
-		forwarders:     cfg.Forwarders,
-		static:         cfg.Static,
-		prefix:         prefix,
-		defaultForward: cfg.Default,
-		strictIPv6:     cfg.StrictIPv6,
-		ia:             cfg.IA,
-                FallBack:       cfg.FallBack,
+	health.Configure(cfg.Upstream, logger.Sub("upstream"))
+	go health.Run()
+
+	router, err := NewRouter(&cfg, pool, logger)
+	if err != nil {
+		logger.Fatal("Failed to load configs", "err", err)
 	}
 
-	logger := NewLogger(cfg.LogLevel)
+	var limiter *RateLimiter
+	if cfg.RateLimit.Rate > 0 {
+		limiter = NewRateLimiter(cfg.RateLimit.Rate, cfg.RateLimit.Burst,
+			cfg.RateLimit.IPv4Prefix, cfg.RateLimit.IPv6Prefix, cfg.RateLimit.Slip)
+		go limiter.Run(time.Minute, logger)
+		metrics.NewCounterFunc("yggdns64_ratelimit_limited_total", "Queries over rate limit.", func() float64 {
+			limited, _ := limiter.Stats()
+			return float64(limited)
+		})
+		metrics.NewCounterFunc("yggdns64_ratelimit_slipped_total", "Truncated responses sent to limited clients.", func() float64 {
+			_, slipped := limiter.Stats()
+			return float64(slipped)
+		})
+	}
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		switch r.Opcode {
-		case dns.OpcodeQuery:
-			m, err := dnsProxy.getResponse(r)
-			if err != nil {
-				logger.Errorf("Failed lookup for %s with error: %s\n", r, err.Error())
+	if cfg.Metrics != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			if cfg.LogAPI {
+				mux.Handle("/log-level", logger)
 			}
-			w.WriteMsg(m)
+			logger.Info("Metrics started", "url", "http://"+cfg.Metrics+"/metrics")
+			if err := http.ListenAndServe(cfg.Metrics, mux); err != nil {
+				logger.Fatal("Failed to start metrics", "err", err)
+			}
+		}()
+	}
+
+	var queryLog *QueryLog
+	if cfg.QueryLog.Sink != "" {
+		queryLog, err = NewQueryLog(&cfg.QueryLog)
+		if err != nil {
+			logger.Fatal("Failed to open query log", "err", err)
 		}
-	})
+	}
+
+	handler := &Handler{
+		limiter:  limiter,
+		queryLog: queryLog,
+		logger:   logger,
+	}
+	handler.router.Store(router)
+	dns.Handle(".", handler)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go NewReloader(cfgFile, &cfg, handler, pool, logger).Run(hup, cfg.WatchCfg)
+
+	servers := NewServerGroup(logger)
+	servers.Add(cfg.ListenUDP, "udp", dns.DefaultServeMux)
+	servers.Add(cfg.ListenTCP, "tcp", dns.DefaultServeMux)
+	if cfg.ListenTLS != "" || cfg.ListenHTTPS != "" {
+		certs, err := NewCertStore(cfg.TLS.Cert, cfg.TLS.Key, logger)
+		if err != nil {
+			logger.Fatal("Failed to load certificate", "err", err)
+		}
+		servers.AddTLS(cfg.ListenTLS, certs.TLSConfig(), dns.DefaultServeMux)
+		servers.AddHTTPS(cfg.ListenHTTPS, certs.TLSConfig(), dns.DefaultServeMux)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	server := &dns.Server{Addr: cfg.Listen, Net: "udp"}
-	logger.Infof("Starting at %s\n", cfg.Listen)
-	err = server.ListenAndServe()
+	err = servers.Run(stop)
 	if err != nil {
-		logger.Errorf("Failed to start server: %s\n ", err.Error())
+		logger.Fatal("Failed to start server", "err", err)
 	}
 }
@@ -0,0 +1,238 @@
+package main
+
+// Prometheus metrics in text exposition format
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, addLabel(key, "le", formatValue(le)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, addLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// ValueFunc is a counter or gauge read on scrape
+type ValueFunc struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+func (f *ValueFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", f.name, f.help, f.name, f.kind, f.name, formatValue(f.value()))
+}
+
+type Metrics struct {
+	Queries         *CounterVec
+	AAAAAnswers     *CounterVec
+	Cache           *CounterVec
+	UpstreamLatency *HistogramVec
+	UpstreamErrors  *CounterVec
+	// UpstreamEjections counts servers taken out by health checking
+	UpstreamEjections *CounterVec
+	inFlight          int64
+
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewMetrics() *Metrics {
+	m := new(Metrics)
+	m.Queries = m.NewCounterVec("yggdns64_queries_total", "Queries by type and response code.", "qtype", "rcode")
+	m.AAAAAnswers = m.NewCounterVec("yggdns64_aaaa_answers_total", "AAAA answers by the way they were built.", "result")
+	m.Cache = m.NewCounterVec("yggdns64_cache_total", "Cache lookups and evictions.", "event")
+	m.UpstreamLatency = m.NewHistogramVec("yggdns64_upstream_duration_seconds", "Upstream exchange latency.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}, "upstream")
+	m.UpstreamErrors = m.NewCounterVec("yggdns64_upstream_errors_total", "Failed upstream exchanges.", "upstream")
+	m.UpstreamEjections = m.NewCounterVec("yggdns64_upstream_ejections_total", "Upstreams ejected after consecutive failures.", "upstream")
+	m.NewGaugeFunc("yggdns64_in_flight_requests", "Requests being processed.", func() float64 {
+		return float64(atomic.LoadInt64(&m.inFlight))
+	})
+	return m
+}
+
+func (m *Metrics) register(c collector) {
+	m.mu.Lock()
+	m.collectors = append(m.collectors, c)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	m.register(c)
+	return c
+}
+
+func (m *Metrics) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	m.register(h)
+	return h
+}
+
+func (m *Metrics) NewCounterFunc(name, help string, value func() float64) {
+	m.register(&ValueFunc{name: name, help: help, kind: "counter", value: value})
+}
+
+func (m *Metrics) NewGaugeFunc(name, help string, value func() float64) {
+	m.register(&ValueFunc{name: name, help: help, kind: "gauge", value: value})
+}
+
+// Begin counts request in flight. Call the returned function when done.
+func (m *Metrics) Begin() func() {
+	atomic.AddInt64(&m.inFlight, 1)
+	return func() { atomic.AddInt64(&m.inFlight, -1) }
+}
+
+// ObserveUpstream records result of upstream exchange
+func (m *Metrics) ObserveUpstream(server string, start time.Time, err error) {
+	if err != nil {
+		m.UpstreamErrors.Inc(server)
+		return
+	}
+	m.UpstreamLatency.Observe(time.Since(start).Seconds(), server)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, "%s=%q", name, value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func addLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
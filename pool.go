@@ -0,0 +1,297 @@
+package main
+
+// Stateful IPv4 to mesh address mapping. Addresses are leased from
+// a configured range instead of embedding IPv4 into the prefix.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type poolLease struct {
+	index   uint64
+	v4      [4]byte
+	expires time.Time
+}
+
+// Lease record in the exported table
+type PoolEntry struct {
+	IPv6    string    `json:"ipv6"`
+	IPv4    string    `json:"ipv4"`
+	Expires time.Time `json:"expires"`
+}
+
+type Pool struct {
+	mu      sync.Mutex
+	network *net.IPNet
+	size    uint64
+	next    uint64
+	lease   time.Duration
+	byV4    map[[4]byte]*poolLease
+	byIndex map[uint64]*poolLease
+	export  string
+	dirty   bool
+	// signals new allocation, so the table is exported without delay
+	changed chan struct{}
+}
+
+// NewPool creates pool for the range. Range must be between /64 and /127.
+// If export file exists, unexpired leases are loaded from it.
+func NewPool(cidr string, lease time.Duration, export string) (*Pool, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if ip.To4() != nil || ones < 64 || ones >= bits {
+		return nil, fmt.Errorf("pool range must be IPv6 between /64 and /127: %s", cidr)
+	}
+	if lease <= 0 {
+		return nil, fmt.Errorf("pool lease must be positive")
+	}
+
+	p := &Pool{
+		network: network,
+		size:    1 << uint(bits-ones),
+		next:    1,
+		lease:   lease,
+		byV4:    make(map[[4]byte]*poolLease),
+		byIndex: make(map[uint64]*poolLease),
+		export:  export,
+		changed: make(chan struct{}, 1),
+	}
+	if ones == 64 {
+		// 1<<64 overflows
+		p.size = 0
+	}
+
+	if export != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Pool) address(index uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.network.IP)
+	binary.BigEndian.PutUint64(ip[8:], binary.BigEndian.Uint64(ip[8:])|index)
+	return ip
+}
+
+func (p *Pool) index(ip net.IP) (uint64, bool) {
+	ip = ip.To16()
+	if ip == nil || !p.network.Contains(ip) {
+		return 0, false
+	}
+	mask := ^binary.BigEndian.Uint64(net.IP(p.network.Mask)[8:])
+	return binary.BigEndian.Uint64(ip[8:]) & mask, true
+}
+
+// Get returns mesh address for IPv4, allocating a new lease if needed.
+// Lease is prolonged on every call.
+func (p *Pool) Get(r net.IP) (net.IP, error) {
+	v4 := r.To4()
+	if v4 == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %s", r)
+	}
+	var key [4]byte
+	copy(key[:], v4)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	l, ok := p.byV4[key]
+	if !ok {
+		index, err := p.allocate(now)
+		if err != nil {
+			return nil, err
+		}
+		l = &poolLease{index: index, v4: key}
+		p.byV4[key] = l
+		p.byIndex[index] = l
+		select {
+		case p.changed <- struct{}{}:
+		default:
+		}
+	}
+	l.expires = now.Add(p.lease)
+	p.dirty = true
+	return p.address(l.index), nil
+}
+
+// allocate finds free or expired index starting from the last allocated one.
+// Index 0 (the range address itself) is never used.
+func (p *Pool) allocate(now time.Time) (uint64, error) {
+	for i := uint64(1); i != p.size; i++ {
+		index := p.next
+		p.next++
+		if p.next == p.size {
+			p.next = 1
+		}
+		l, ok := p.byIndex[index]
+		if !ok {
+			return index, nil
+		}
+		if now.After(l.expires) {
+			delete(p.byV4, l.v4)
+			delete(p.byIndex, index)
+			return index, nil
+		}
+	}
+	return 0, fmt.Errorf("pool %s exhausted", p.network)
+}
+
+// Lookup returns IPv4 address leased to mesh address
+func (p *Pool) Lookup(ip net.IP) (net.IP, error) {
+	index, ok := p.index(ip)
+	if !ok {
+		return nil, fmt.Errorf("address doesn't belong to pool")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.byIndex[index]
+	if !ok || time.Now().After(l.expires) {
+		return nil, fmt.Errorf("no lease for %s", ip)
+	}
+	v4 := make(net.IP, net.IPv4len)
+	copy(v4, l.v4[:])
+	return v4, nil
+}
+
+// Lease returns lease duration
+func (p *Pool) Lease() time.Duration {
+	return p.lease
+}
+
+// Entries returns unexpired leases
+func (p *Pool) Entries() []PoolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	indexes := make([]uint64, 0, len(p.byIndex))
+	for index, l := range p.byIndex {
+		if !now.After(l.expires) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	entries := make([]PoolEntry, 0, len(indexes))
+	for _, index := range indexes {
+		l := p.byIndex[index]
+		entries = append(entries, PoolEntry{
+			IPv6:    p.address(index).String(),
+			IPv4:    net.IP(l.v4[:]).String(),
+			Expires: l.expires,
+		})
+	}
+	return entries
+}
+
+// Purge removes expired leases
+func (p *Pool) Purge() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for index, l := range p.byIndex {
+		if now.After(l.expires) {
+			delete(p.byV4, l.v4)
+			delete(p.byIndex, index)
+			p.dirty = true
+		}
+	}
+}
+
+// Run purges expired leases and writes the export file when the table
+// has changed. New leases are exported immediately. Never returns.
+func (p *Pool) Run(interval time.Duration, logger *Log) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			p.Purge()
+		case <-p.changed:
+		}
+
+		p.mu.Lock()
+		dirty := p.dirty
+		p.dirty = false
+		p.mu.Unlock()
+
+		if dirty && p.export != "" {
+			if err := p.save(); err != nil {
+				logger.Error("Failed to export pool", "file", p.export, "err", err)
+			}
+		}
+	}
+}
+
+// save writes leases to the export file atomically
+func (p *Pool) save() error {
+	body, err := json.MarshalIndent(p.Entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.export), ".pool")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.export)
+}
+
+// load restores leases from the export file
+func (p *Pool) load() error {
+	body, err := os.ReadFile(p.export)
+	if err != nil {
+		return err
+	}
+	var entries []PoolEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return fmt.Errorf("%s: %w", p.export, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range entries {
+		index, ok := p.index(net.ParseIP(e.IPv6))
+		v4 := net.ParseIP(e.IPv4).To4()
+		if !ok || index == 0 || v4 == nil || now.After(e.Expires) {
+			continue
+		}
+		l := &poolLease{index: index, expires: e.Expires}
+		copy(l.v4[:], v4)
+		p.byV4[l.v4] = l
+		p.byIndex[index] = l
+		if index >= p.next {
+			p.next = index + 1
+			if p.next == p.size {
+				p.next = 1
+			}
+		}
+	}
+	return nil
+}
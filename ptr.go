@@ -0,0 +1,134 @@
+package main
+
+// PTR answers built without upstream
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of PTR records with forward and generated names
+const ptrTTL = 300
+
+// staticReverse maps addresses of static records to PTR records of their
+// names: AAAA by the address, A by IPv4 to answer for mesh addresses
+// made of it. Wildcard names have no PTR.
+func staticReverse(records map[string][]dns.RR) map[netip.Addr][]dns.RR {
+	reverse := make(map[netip.Addr][]dns.RR)
+	for name, rrs := range records {
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+		for _, rr := range rrs {
+			var ip netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip, _ = netip.AddrFromSlice(rr.A)
+			case *dns.AAAA:
+				ip, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			ip = ip.Unmap()
+			reverse[ip] = append(reverse[ip], newPTR("", dns.Fqdn(name), rr.Header().Ttl))
+		}
+	}
+	// Stable order of names for the same address
+	for _, ptrs := range reverse {
+		sort.Slice(ptrs, func(i, j int) bool {
+			return ptrs[i].(*dns.PTR).Ptr < ptrs[j].(*dns.PTR).Ptr
+		})
+	}
+	return reverse
+}
+
+func newPTR(name, target string, ttl uint32) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: target,
+	}
+}
+
+// localPTR builds answer with the PTR records named as the query
+func localPTR(requestMsg *dns.Msg, ptrs ...dns.RR) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(requestMsg)
+	for _, rr := range ptrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = requestMsg.Question[0].Name
+		msg.Answer = append(msg.Answer, rr)
+	}
+	return msg
+}
+
+// rememberName keeps the name synthesized address was made for. Cached
+// PTR of the address is removed when the name changes.
+func (proxy *DNSProxy) rememberName(name string, ip netip.Addr) {
+	if proxy.names == nil {
+		return
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	if old, ok := proxy.forwardName(ip); !ok || old != name {
+		proxy.forgetPTR(ip)
+	}
+	proxy.names.SetDefault(ip.String(), name)
+}
+
+// forgetPTR removes cached PTR answers of the address
+func (proxy *DNSProxy) forgetPTR(ip netip.Addr) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return
+	}
+	q := dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET}
+	for _, do := range []bool{false, true} {
+		for _, cd := range []bool{false, true} {
+			proxy.Cache.Delete(questionKey(&q, do, cd))
+		}
+	}
+}
+
+// forwardName returns the last name synthesized address was made for
+func (proxy *DNSProxy) forwardName(ip netip.Addr) (string, bool) {
+	if proxy.names == nil {
+		return "", false
+	}
+	name, ok := proxy.names.Get(ip.String())
+	if !ok {
+		return "", false
+	}
+	return name.(string), true
+}
+
+// generatedName builds name from the fallback template: {ipv4} is
+// replaced with the IPv4 address, {ipv6} with the mesh one, both with
+// dashes instead of dots and colons
+func generatedName(template string, ip, v4 netip.Addr) string {
+	name := strings.NewReplacer(
+		"{ipv4}", strings.ReplaceAll(v4.String(), ".", "-"),
+		"{ipv6}", strings.ReplaceAll(ip.String(), ":", "-"),
+	).Replace(template)
+	return dns.Fqdn(name)
+}
+
+// checkPTRFallback returns error if the template doesn't give a domain name
+func checkPTRFallback(template string) error {
+	name := generatedName(template, netip.MustParseAddr("200::1"), netip.MustParseAddr("10.0.0.1"))
+	if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, "{} \t") || name == "." {
+		return fmt.Errorf("%q doesn't make a domain name", template)
+	}
+	return nil
+}
+
+// newNameTable returns table of forward names or nil if disabled
+func newNameTable(cfg *Config) *Cache {
+	if !cfg.PTR.ForwardNames {
+		return nil
+	}
+	exp := cfg.PTR.Expiration.Duration()
+	return New(exp, exp)
+}
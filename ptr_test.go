@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerPTR knows reverse names of 10.0.0.2 and 8.8.8.8, forward names
+// have no AAAA and fwd.test/other.test share an IPv4
+func answerPTR(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	var rr dns.RR
+	switch q.Qtype {
+	case dns.TypePTR:
+		names := map[string]string{
+			"2.0.0.10.in-addr.arpa.": "upstream.example.",
+			"8.8.8.8.in-addr.arpa.":  "dns.google.",
+		}
+		if names[q.Name] == "" {
+			m.Rcode = dns.RcodeNameError
+			break
+		}
+		rr = newPTR(q.Name, names[q.Name], 60)
+	case dns.TypeA:
+		rr, _ = dns.NewRR(q.Name + " 60 IN A 10.0.0.3")
+	}
+	if rr != nil {
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+func TestPTRAnswers(t *testing.T) {
+	upstream := startUDPServer(t, answerPTR)
+	cfg, err := parseConfig(t, reloadConfig(upstream)+`
+static:
+  host.test: 10.0.0.1
+  v6.test: 2001:db8::1
+  "*.wild.test": 10.0.0.4
+ptr:
+  forward-names: yes
+  fallback: "ip-{ipv4}.mesh"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewDNSProxy(cfg, nil, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mesh := func(v4 string) string {
+		ip, err := proxy.translator.Embed("", netip.MustParseAddr(v4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, _ := dns.ReverseAddr(ip.String())
+		return name
+	}
+	reverse := func(ip string) string {
+		name, _ := dns.ReverseAddr(ip)
+		return name
+	}
+
+	// Steps run in order, forward names are learned from AAAA answers
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		ptr   string
+		path  string
+	}{
+		{mesh("10.0.0.1"), dns.TypePTR, dns.RcodeSuccess, "host.test.", PathStatic},
+		{reverse("2001:db8::1"), dns.TypePTR, dns.RcodeSuccess, "v6.test.", PathStatic},
+		// Reverse zones of IPv4 and foreign IPv6 are not ours
+		{reverse("10.0.0.1"), dns.TypePTR, dns.RcodeNameError, "", PathUpstream},
+		{reverse("8.8.8.8"), dns.TypePTR, dns.RcodeSuccess, "dns.google.", PathUpstream},
+		{reverse("2001:db8::2"), dns.TypePTR, dns.RcodeNameError, "", PathUpstream},
+		{mesh("10.0.0.4"), dns.TypePTR, dns.RcodeSuccess, "ip-10-0-0-4.mesh.", PathGenerated},
+		{mesh("10.0.0.2"), dns.TypePTR, dns.RcodeSuccess, "upstream.example.", PathUpstream},
+		{mesh("10.0.0.5"), dns.TypePTR, dns.RcodeSuccess, "ip-10-0-0-5.mesh.", PathGenerated},
+		{mesh("10.0.0.3"), dns.TypePTR, dns.RcodeSuccess, "ip-10-0-0-3.mesh.", PathGenerated},
+		{mesh("10.0.0.3"), dns.TypePTR, dns.RcodeSuccess, "ip-10-0-0-3.mesh.", PathCache},
+		// Learned name replaces cached fallback
+		{"fwd.test.", dns.TypeAAAA, dns.RcodeSuccess, "", PathSynthesized},
+		{mesh("10.0.0.3"), dns.TypePTR, dns.RcodeSuccess, "fwd.test.", PathForwardName},
+		{mesh("10.0.0.3"), dns.TypePTR, dns.RcodeSuccess, "fwd.test.", PathCache},
+		{"other.test.", dns.TypeAAAA, dns.RcodeSuccess, "", PathSynthesized},
+		{mesh("10.0.0.3"), dns.TypePTR, dns.RcodeSuccess, "other.test.", PathForwardName},
+	}
+	for i, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		rec := new(QueryRecord)
+		resp, err := proxy.getResponse(req, rec)
+		if err != nil {
+			t.Fatalf("%d %s: %s", i, tt.name, err)
+		}
+		if resp.Rcode != tt.rcode || rec.Path != tt.path {
+			t.Errorf("%d %s: %s from %s, want %s from %s", i, tt.name,
+				dns.RcodeToString[resp.Rcode], rec.Path, dns.RcodeToString[tt.rcode], tt.path)
+		}
+		if tt.qtype != dns.TypePTR {
+			continue
+		}
+		var ptr string
+		if len(resp.Answer) == 1 {
+			ptr = resp.Answer[0].(*dns.PTR).Ptr
+		}
+		if ptr != tt.ptr || len(resp.Answer) > 1 {
+			t.Errorf("%d %s: answer %v, want %s", i, tt.name, resp.Answer, tt.ptr)
+		}
+	}
+}
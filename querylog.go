@@ -0,0 +1,239 @@
+package main
+
+// Per-query log written as JSON lines
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways the answer was built
+const (
+	PathUpstream    = "upstream"
+	PathCache       = "cache"
+	PathStatic      = "static"
+	PathNativeAAAA  = "native-aaaa"
+	PathSynthesized = "synthesized"
+	PathFallback    = "fallback"
+	PathForwardName = "forward-name"
+	PathGenerated   = "generated"
+	PathRefused     = "refused"
+)
+
+type QueryRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Name      string    `json:"qname,omitempty"`
+	Type      string    `json:"qtype,omitempty"`
+	Forwarder string    `json:"forwarder,omitempty"`
+	Path      string    `json:"path"`
+	Rcode     string    `json:"rcode"`
+	Latency   float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// QuerySink receives formatted records, one line each
+type QuerySink interface {
+	Write(line []byte) error
+}
+
+type QueryLog struct {
+	sink    QuerySink
+	sample  float64
+	redact  map[string]string
+	hashKey []byte
+}
+
+func validateQueryLog(cfg *QueryLogConfig) error {
+	switch cfg.Sink {
+	case "stdout", "syslog":
+	case "file":
+		if cfg.File == "" {
+			return fmt.Errorf("file is required for file sink")
+		}
+	default:
+		return fmt.Errorf("sink %q must be one of 'stdout/file/syslog'", cfg.Sink)
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return fmt.Errorf("sample %g is out of range 0-1", cfg.Sample)
+	}
+	for field, mode := range cfg.Redact {
+		switch field {
+		case "client", "qname", "forwarder":
+		default:
+			return fmt.Errorf("redact: unknown field %q", field)
+		}
+		switch mode {
+		case "remove", "hash":
+		case "truncate":
+			if field != "client" {
+				return fmt.Errorf("redact.%s: truncate is only supported for client", field)
+			}
+		default:
+			return fmt.Errorf("redact.%s: %q must be one of 'remove/hash/truncate'", field, mode)
+		}
+	}
+	return nil
+}
+
+func NewQueryLog(cfg *QueryLogConfig) (*QueryLog, error) {
+	if err := validateQueryLog(cfg); err != nil {
+		return nil, err
+	}
+	ql := &QueryLog{sample: cfg.Sample, redact: cfg.Redact}
+	if ql.sample == 0 {
+		ql.sample = 1
+	}
+	// Without a secret key hash of an address or name could be reversed
+	// by hashing all candidates
+	ql.hashKey = []byte(cfg.HashKey)
+	if len(ql.hashKey) == 0 {
+		ql.hashKey = make([]byte, 32)
+		if _, err := crand.Read(ql.hashKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	switch cfg.Sink {
+	case "stdout":
+		ql.sink = &writerSink{f: os.Stdout}
+	case "file":
+		ql.sink, err = newFileSink(cfg.File, cfg.MaxSize*1024*1024, cfg.MaxBackups)
+	case "syslog":
+		ql.sink, err = newSyslogSink(cfg.Syslog)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ql, nil
+}
+
+// Log writes the record. Failed queries are never sampled out.
+func (ql *QueryLog) Log(rec *QueryRecord) error {
+	if ql == nil {
+		return nil
+	}
+	if ql.sample < 1 && rec.Error == "" && rand.Float64() >= ql.sample {
+		return nil
+	}
+	r := *rec
+	r.Client = ql.redactField("client", r.Client)
+	r.Name = ql.redactField("qname", r.Name)
+	r.Forwarder = ql.redactField("forwarder", r.Forwarder)
+	line, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	return ql.sink.Write(append(line, '\n'))
+}
+
+func (ql *QueryLog) redactField(field, value string) string {
+	if value == "" {
+		return value
+	}
+	switch ql.redact[field] {
+	case "remove":
+		return ""
+	case "hash":
+		mac := hmac.New(sha256.New, ql.hashKey)
+		mac.Write([]byte(strings.ToLower(value)))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case "truncate":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return ""
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return value
+}
+
+type writerSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (s *writerSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.f.Write(line)
+	return err
+}
+
+// fileSink rotates the file when it grows over maxSize:
+// file -> file.1 -> file.2 ... up to maxBackups
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	s.f.Close()
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		os.Rename(s.path, s.path+".1")
+	} else {
+		os.Remove(s.path)
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
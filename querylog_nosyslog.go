@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "fmt"
+
+func newSyslogSink(addr string) (QuerySink, error) {
+	return nil, fmt.Errorf("syslog sink is unsupported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog or to "network://address"
+func newSyslogSink(addr string) (QuerySink, error) {
+	var network string
+	if i := strings.Index(addr, "://"); i >= 0 {
+		network, addr = addr[:i], addr[i+3:]
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "yggdns64")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(strings.TrimSuffix(string(line), "\n"))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRedactField(t *testing.T) {
+	redact := map[string]string{"client": "truncate", "qname": "hash", "forwarder": "remove"}
+	ql, err := NewQueryLog(&QueryLogConfig{Sink: "stdout", Redact: redact, HashKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("a.example."))
+	hash := hex.EncodeToString(mac.Sum(nil)[:8])
+
+	tests := []struct {
+		field, value, want string
+	}{
+		{"client", "192.0.2.77", "192.0.2.0"},
+		{"client", "2001:db8:1:2::1", "2001:db8:1::"},
+		{"client", "not an address", ""},
+		{"qname", "a.example.", hash},
+		{"qname", "A.Example.", hash},
+		{"qname", "", ""},
+		{"forwarder", "192.0.2.53:53", ""},
+	}
+	for _, tt := range tests {
+		if got := ql.redactField(tt.field, tt.value); got != tt.want {
+			t.Errorf("%s %q: got %q, want %q", tt.field, tt.value, got, tt.want)
+		}
+	}
+}
+
+// Hashes depend on the key, random one is used when not configured
+func TestRedactHashKey(t *testing.T) {
+	redact := map[string]string{"qname": "hash"}
+	hash := func(key string) string {
+		ql, err := NewQueryLog(&QueryLogConfig{Sink: "stdout", Redact: redact, HashKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ql.redactField("qname", "a.example.")
+	}
+	if hash("one") != hash("one") {
+		t.Error("same key gives different hashes")
+	}
+	if hash("one") == hash("two") {
+		t.Error("different keys give the same hash")
+	}
+	if hash("") == hash("") {
+		t.Error("random keys give the same hash")
+	}
+}
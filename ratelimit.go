@@ -0,0 +1,131 @@
+package main
+
+// Per-client rate limiting with RRL-like slip
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	dropped uint32
+}
+
+// RateLimiter is a token bucket per client network. Clients are grouped
+// by IPv4/IPv6 prefix. Every slip-th limited query is answered with
+// an empty truncated response, so legitimate clients retry over TCP.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	slip    uint32
+	v4mask  net.IPMask
+	v6mask  net.IPMask
+	buckets map[[net.IPv6len]byte]*bucket
+
+	// counters
+	limited uint64
+	slipped uint64
+}
+
+// Verdict of rate limiter
+type RateVerdict int
+
+const (
+	RateAllow RateVerdict = iota
+	RateDrop
+	RateSlip
+)
+
+func NewRateLimiter(rate, burst float64, v4len, v6len int, slip uint32) *RateLimiter {
+	if burst < rate {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		slip:    slip,
+		v4mask:  net.CIDRMask(v4len, 8*net.IPv4len),
+		v6mask:  net.CIDRMask(v6len, 8*net.IPv6len),
+		buckets: make(map[[net.IPv6len]byte]*bucket),
+	}
+}
+
+func (rl *RateLimiter) key(ip net.IP) (key [net.IPv6len]byte) {
+	if v4 := ip.To4(); v4 != nil {
+		copy(key[:], v4.Mask(rl.v4mask).To16())
+	} else {
+		copy(key[:], ip.Mask(rl.v6mask))
+	}
+	return
+}
+
+// Check takes a token for the client
+func (rl *RateLimiter) Check(ip net.IP) RateVerdict {
+	key := rl.key(ip)
+	now := time.Now()
+
+	rl.mu.Lock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.dropped = 0
+		rl.mu.Unlock()
+		return RateAllow
+	}
+	b.dropped++
+	dropped := b.dropped
+	rl.mu.Unlock()
+
+	atomic.AddUint64(&rl.limited, 1)
+	if rl.slip > 0 && dropped%rl.slip == 0 {
+		atomic.AddUint64(&rl.slipped, 1)
+		return RateSlip
+	}
+	return RateDrop
+}
+
+// Stats returns number of limited queries and truncated responses sent
+func (rl *RateLimiter) Stats() (limited, slipped uint64) {
+	return atomic.LoadUint64(&rl.limited), atomic.LoadUint64(&rl.slipped)
+}
+
+// Purge removes buckets of clients idle long enough to refill
+func (rl *RateLimiter) Purge() {
+	idle := time.Duration(rl.burst/rl.rate*float64(time.Second)) + time.Second
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > idle {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Run purges idle buckets and logs counters when they change. Never returns.
+func (rl *RateLimiter) Run(interval time.Duration, logger *Log) {
+	var lastLimited uint64
+	for range time.Tick(interval) {
+		rl.Purge()
+		limited, slipped := rl.Stats()
+		if limited != lastLimited {
+			logger.Info("Rate limit", "limited", limited, "slipped", slipped)
+			lastLimited = limited
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// check runs n queries and counts verdicts
+func check(rl *RateLimiter, ip net.IP, n int) (verdicts map[RateVerdict]int) {
+	verdicts = make(map[RateVerdict]int)
+	for i := 0; i < n; i++ {
+		verdicts[rl.Check(ip)]++
+	}
+	return
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	tests := []struct {
+		name         string
+		rate, burst  float64
+		slip         uint32
+		queries      int
+		allow, slips int
+	}{
+		{"burst", 1, 5, 0, 5, 5, 0},
+		{"over burst", 1, 5, 0, 8, 5, 0},
+		{"burst below rate", 10, 2, 0, 12, 10, 0},
+		{"slip every 2nd", 1, 5, 2, 15, 5, 5},
+		{"slip every 3rd", 1, 5, 3, 15, 5, 3},
+		{"slip every one", 1, 1, 1, 4, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := NewRateLimiter(tt.rate, tt.burst, 24, 56, tt.slip)
+			v := check(rl, net.ParseIP("192.0.2.1"), tt.queries)
+			drops := tt.queries - tt.allow - tt.slips
+			if v[RateAllow] != tt.allow || v[RateSlip] != tt.slips || v[RateDrop] != drops {
+				t.Errorf("allowed %d, slipped %d, dropped %d; want %d, %d, %d",
+					v[RateAllow], v[RateSlip], v[RateDrop], tt.allow, tt.slips, drops)
+			}
+			limited, slipped := rl.Stats()
+			if limited != uint64(tt.queries-tt.allow) || slipped != uint64(tt.slips) {
+				t.Errorf("stats %d limited, %d slipped", limited, slipped)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	rl := NewRateLimiter(2, 4, 24, 56, 0)
+	ip := net.ParseIP("192.0.2.1")
+	check(rl, ip, 4)
+	if rl.Check(ip) == RateAllow {
+		t.Fatal("allowed with empty bucket")
+	}
+
+	// 1.5 seconds at 2 qps refill 3 tokens
+	rl.buckets[rl.key(ip)].last = time.Now().Add(-1500 * time.Millisecond)
+	if v := check(rl, ip, 4); v[RateAllow] != 3 {
+		t.Errorf("allowed %d after refill, want 3", v[RateAllow])
+	}
+
+	// Long idle refills up to burst only
+	rl.buckets[rl.key(ip)].last = time.Now().Add(-time.Hour)
+	if v := check(rl, ip, 6); v[RateAllow] != 4 {
+		t.Errorf("allowed %d after idle, want 4", v[RateAllow])
+	}
+}
+
+// Clients share a bucket within the prefix
+func TestRateLimiterPrefix(t *testing.T) {
+	rl := NewRateLimiter(1, 2, 24, 56, 0)
+	tests := []struct {
+		ip    string
+		allow bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.200", true},
+		{"192.0.2.1", false},
+		{"192.0.3.1", true},
+		{"2001:db8:0:1::1", true},
+		{"2001:db8:0:1:ffff::1", true},
+		{"2001:db8:0:1::2", false},
+		{"2001:db8:0:100::1", true},
+	}
+	for _, tt := range tests {
+		if allow := rl.Check(net.ParseIP(tt.ip)) == RateAllow; allow != tt.allow {
+			t.Errorf("%s: allowed %v, want %v", tt.ip, allow, tt.allow)
+		}
+	}
+}
+
+func TestRateLimiterPurge(t *testing.T) {
+	rl := NewRateLimiter(1, 2, 24, 56, 0)
+	rl.Check(net.ParseIP("192.0.2.1"))
+	rl.Check(net.ParseIP("198.51.100.1"))
+	rl.buckets[rl.key(net.ParseIP("192.0.2.1"))].last = time.Now().Add(-time.Minute)
+	rl.Purge()
+	if len(rl.buckets) != 1 {
+		t.Errorf("%d buckets after purge, want 1", len(rl.buckets))
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+// Configuration reload on SIGHUP or file change
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Reloader re-reads configuration and swaps it into the running handler.
+// On any error the old configuration stays active.
+type Reloader struct {
+	mu      sync.Mutex
+	path    string
+	cfg     *Config
+	handler *Handler
+	pool    *Pool
+	logger  *Log
+}
+
+func NewReloader(path string, cfg *Config, handler *Handler, pool *Pool, logger *Log) *Reloader {
+	return &Reloader{path: path, cfg: cfg, handler: handler, pool: pool, logger: logger}
+}
+
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := parseFile(r.path)
+	if err != nil {
+		return err
+	}
+	if cfg.Pool != r.cfg.Pool {
+		return fmt.Errorf("pool settings can't be changed without restart")
+	}
+	if cfg.ListenUDP != r.cfg.ListenUDP || cfg.ListenTCP != r.cfg.ListenTCP ||
+		cfg.ListenTLS != r.cfg.ListenTLS || cfg.ListenHTTPS != r.cfg.ListenHTTPS || cfg.TLS != r.cfg.TLS ||
+		cfg.Metrics != r.cfg.Metrics || cfg.LogAPI != r.cfg.LogAPI || cfg.RateLimit != r.cfg.RateLimit ||
+		!reflect.DeepEqual(cfg.QueryLog, r.cfg.QueryLog) || cfg.LogFormat != r.cfg.LogFormat {
+		r.logger.Warn("Listeners, TLS files, metrics, rate-limit, query-log and log-format are not reloaded, restart required")
+	}
+
+	// Check levels before changing anything
+	if _, err := parseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	for name, level := range cfg.LogLevels {
+		if _, err := parseLevel(level); err != nil {
+			return fmt.Errorf("log-levels.%s: %w", name, err)
+		}
+	}
+
+	router, err := NewRouter(cfg, r.pool, r.logger)
+	if err != nil {
+		return err
+	}
+	router.inheritCaches(r.handler.router.Load())
+
+	r.handler.router.Store(router)
+	r.cfg = cfg
+	health.Configure(cfg.Upstream, r.logger.Sub("upstream"))
+	health.Retain(cfg.upstreamServers(), cfg.Upstream)
+
+	r.logger.SetLevel("", cfg.LogLevel)
+	for _, name := range logSubsystems {
+		if level, ok := cfg.LogLevels[name]; ok {
+			r.logger.SetLevel(name, level)
+		} else {
+			r.logger.ClearLevel(name)
+		}
+	}
+	return nil
+}
+
+// Run reloads configuration on signal and when static files change.
+// If watch is set, the config file is watched too. Never returns.
+func (r *Reloader) Run(hup <-chan os.Signal, watch bool) {
+	ticker := time.Tick(5 * time.Second)
+	stamps := r.stamps(watch)
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker:
+			if reflect.DeepEqual(r.stamps(watch), stamps) {
+				continue
+			}
+		}
+		stamps = r.stamps(watch)
+		if err := r.Reload(); err != nil {
+			r.logger.Error("Reload failed, old config is active", "file", r.path, "err", err)
+			continue
+		}
+		r.logger.Info("Config reloaded", "file", r.path)
+	}
+}
+
+// fileStamp tells if file was changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stamps returns stamps of watched files, missing files are skipped
+func (r *Reloader) stamps(watch bool) map[string]fileStamp {
+	r.mu.Lock()
+	paths := r.cfg.staticFiles()
+	r.mu.Unlock()
+	if watch {
+		paths = append(paths, r.path)
+	}
+
+	stamps := make(map[string]fileStamp)
+	for _, path := range paths {
+		if st, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{st.ModTime(), st.Size()}
+		}
+	}
+	return stamps
+}
+
+// inheritCaches takes caches of the same views from the old router
+func (r *Router) inheritCaches(old *Router) {
+	r.def.inheritCache(old.def)
+	for i := range r.views {
+		for j := range old.views {
+			if r.views[i].name == old.views[j].name {
+				r.views[i].proxy.inheritCache(old.views[j].proxy)
+			}
+		}
+	}
+}
+
+// inheritCache reuses cache and forward names of the old proxy, removing
+// entries affected by configuration changes. Cache is not reused if its
+// timers changed.
+func (proxy *DNSProxy) inheritCache(old *DNSProxy) {
+	oc, nc := old.config, proxy.config
+	translation := oc.Prefix != nc.Prefix || oc.MeshPrefix != nc.MeshPrefix ||
+		!reflect.DeepEqual(oc.Prefixes, nc.Prefixes)
+
+	// Forward names are valid while addresses are built the same way
+	if proxy.names != nil && old.names != nil && oc.PTR.Expiration == nc.PTR.Expiration && !translation {
+		proxy.names = old.names
+	}
+
+	if oc.Cache != nc.Cache {
+		return
+	}
+	proxy.Cache = old.Cache
+
+	// These change every answer
+	if !reflect.DeepEqual(oc.Default, nc.Default) || oc.StrictIPv6 != nc.StrictIPv6 || oc.IA != nc.IA ||
+		oc.FallBack != nc.FallBack || oc.TTL != nc.TTL {
+		proxy.Cache.Flush()
+		return
+	}
+
+	suffixes := changedKeys(oc.Forwarders, nc.Forwarders)
+
+	for key, item := range proxy.Cache.Items() {
+		entry, ok := item.Object.(cacheEntry)
+		if !ok || len(entry.msg.Question) == 0 {
+			proxy.Cache.Delete(key)
+			continue
+		}
+		q := entry.msg.Question[0]
+		name := normalizeDomain(q.Name)
+		// PTR may come from static files which are not compared
+		affected := q.Qtype == dns.TypePTR ||
+			translation && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY)
+		for _, domain := range suffixes {
+			affected = affected || inDomain(name, domain)
+		}
+		if affected {
+			proxy.Cache.Delete(key)
+		}
+	}
+}
+
+// changedKeys returns keys added, removed or changed between the maps,
+// normalized as domain names
+func changedKeys[V any](a, b map[string]V) (keys []string) {
+	for k, v := range a {
+		if nv, ok := b[k]; !ok || !reflect.DeepEqual(nv, v) {
+			keys = append(keys, normalizeDomain(k))
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, normalizeDomain(k))
+		}
+	}
+	return
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// reloadConfig is a config with the default server
+func reloadConfig(server string) string {
+	return fmt.Sprintf("listen: 127.0.0.1:5353\nprefix: \"300:dada:feda:f443:ff::\"\ndefault: %s\n", server)
+}
+
+// newTestReloader runs router of the config file like main does
+func newTestReloader(t *testing.T, path string) (*Reloader, *Handler) {
+	t.Helper()
+	cfg, err := parseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := testLogger(t)
+	router, err := NewRouter(cfg, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &Handler{logger: logger}
+	handler.router.Store(router)
+	return NewReloader(path, cfg, handler, nil, logger), handler
+}
+
+func writeFile(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Queries running on the old router finish after the server is replaced
+func TestReloadDrainsOldServers(t *testing.T) {
+	defer func(d time.Duration) { retireDelay = d }(retireDelay)
+	retireDelay = 0
+
+	oldAddr, entered, release := blockingServer(t)
+	newAddr := startUDPServer(t, answerA)
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeFile(t, path, reloadConfig(oldAddr))
+	reloader, handler := newTestReloader(t, path)
+
+	old := handler.router.Load().def.defaultForward
+	u := old.members[0].upstream
+	result := make(chan error, 1)
+	go func() {
+		_, err := old.Exchange(query("slow."))
+		result <- err
+	}()
+	<-entered
+
+	writeFile(t, path, reloadConfig(newAddr))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// Retired with the query running, the transport is still open
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		u.mu.Lock()
+		retired := u.retired
+		u.mu.Unlock()
+		if retired {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old server is not retired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if err := <-result; err != nil {
+		t.Fatalf("query on the old router failed: %s", err)
+	}
+
+	// Closed after the last query
+	if _, err := u.transport.Exchange(query("late."), time.Second); err == nil {
+		t.Error("old transport is open after queries are done")
+	}
+	if _, err := handler.router.Load().def.defaultForward.Exchange(query("new.")); err != nil {
+		t.Errorf("query on the new router failed: %s", err)
+	}
+}
+
+// Old router may start queries after reload, they work during retireDelay
+func TestReloadRetireDelay(t *testing.T) {
+	oldAddr := startUDPServer(t, answerA)
+	newAddr := startUDPServer(t, answerA)
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeFile(t, path, reloadConfig(oldAddr))
+	reloader, handler := newTestReloader(t, path)
+
+	old := handler.router.Load().def.defaultForward
+	writeFile(t, path, reloadConfig(newAddr))
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exchange(query("late.")); err != nil {
+		t.Errorf("query on the old router failed: %s", err)
+	}
+}
+
+func TestInheritCache(t *testing.T) {
+	const base = validConfig + `
+ptr:
+  forward-names: yes
+forwarders:
+  ".corp": 192.0.2.54:53
+`
+	questions := map[string]dns.Question{
+		"a":    {Name: "a.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		"aaaa": {Name: "a.test.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+		"ptr":  {Name: "1.0.0.10.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET},
+		"corp": {Name: "host.corp.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	tests := []struct {
+		name   string
+		change func(*Config)
+		kept   []string
+		names  bool
+	}{
+		{"unchanged", func(*Config) {}, []string{"a", "aaaa", "corp"}, true},
+		{"prefix", func(c *Config) { c.Prefix = "300:1::" }, []string{"a", "corp"}, false},
+		{"forwarder", func(c *Config) { c.Forwarders[".corp"].Servers[0].Address = "192.0.2.55:53" }, []string{"a", "aaaa"}, true},
+		{"new forwarder", func(c *Config) { c.Forwarders["test"] = c.Forwarders[".corp"] }, []string{"corp"}, true},
+		{"default", func(c *Config) { c.Default.Servers[0].Address = "192.0.2.55:53" }, nil, true},
+		{"ttl", func(c *Config) { c.TTL.Min = 60 }, nil, true},
+		{"cache", func(c *Config) { c.Cache.ExpTime = 5 }, nil, true},
+		{"ptr expiration", func(c *Config) { c.PTR.Expiration = 5 }, []string{"a", "aaaa", "corp"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldCfg, err := parseConfig(t, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newCfg, err := parseConfig(t, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(newCfg)
+			old, err := NewDNSProxy(oldCfg, nil, testLogger(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy, err := NewDNSProxy(newCfg, nil, testLogger(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := make(map[string]string)
+			for name, q := range questions {
+				q := q
+				m := new(dns.Msg)
+				m.SetQuestion(q.Name, q.Qtype)
+				keys[name] = cacheKey(&q, m)
+				old.Cache.Set(keys[name], cacheEntry{msg: m, stored: time.Now()}, time.Hour)
+			}
+
+			proxy.inheritCache(old)
+			kept := make(map[string]bool)
+			for _, name := range tt.kept {
+				kept[name] = true
+			}
+			for name, key := range keys {
+				if _, ok := proxy.Cache.Get(key); ok != kept[name] {
+					t.Errorf("%s: cached %v, want %v", name, ok, kept[name])
+				}
+			}
+			if inherited := proxy.names == old.names; inherited != tt.names {
+				t.Errorf("forward names inherited %v, want %v", inherited, tt.names)
+			}
+		})
+	}
+}
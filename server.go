@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// listener is a server run by the group
+type listener interface {
+	// serve blocks while serving, started is called once queries are accepted
+	serve(started func()) error
+	shutdown()
+	addr() string
+	network() string
+}
+
+type dnsListener struct {
+	*dns.Server
+}
+
+func (l dnsListener) serve(started func()) error {
+	l.NotifyStartedFunc = started
+	return l.ListenAndServe()
+}
+
+func (l dnsListener) shutdown()       { l.Shutdown() }
+func (l dnsListener) addr() string    { return l.Addr }
+func (l dnsListener) network() string { return l.Net }
+
+// ServerGroup runs several DNS listeners sharing one handler.
+// Listeners are started and stopped together: if one of them fails,
+// the others are shut down too.
+type ServerGroup struct {
+	servers []listener
+	logger  *Log
+}
+
+type serverResult struct {
+	server  listener
+	started bool
+	err     error
+}
+
+func NewServerGroup(logger *Log) *ServerGroup {
+	return &ServerGroup{logger: logger}
+}
+
+// Add registers a listener. Empty address means "don't listen".
+func (g *ServerGroup) Add(addr, network string, handler dns.Handler) {
+	if addr == "" {
+		return
+	}
+	g.servers = append(g.servers, dnsListener{&dns.Server{Addr: addr, Net: network, Handler: handler}})
+}
+
+// AddTLS registers DNS-over-TLS listener
+func (g *ServerGroup) AddTLS(addr string, config *tls.Config, handler dns.Handler) {
+	if addr == "" {
+		return
+	}
+	g.servers = append(g.servers, dnsListener{&dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: config, Handler: handler}})
+}
+
+// AddHTTPS registers DNS-over-HTTPS listener
+func (g *ServerGroup) AddHTTPS(addr string, config *tls.Config, handler dns.Handler) {
+	if addr == "" {
+		return
+	}
+	g.servers = append(g.servers, newHTTPSListener(addr, config, handler))
+}
+
+// Run starts all listeners and blocks until one of them fails or
+// a signal is received from stop.
+func (g *ServerGroup) Run(stop <-chan os.Signal) error {
+	if len(g.servers) == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+
+	results := make(chan serverResult, 2*len(g.servers))
+	for _, srv := range g.servers {
+		srv := srv
+		go func() {
+			err := srv.serve(func() {
+				results <- serverResult{server: srv, started: true}
+			})
+			if err == nil {
+				err = fmt.Errorf("stopped")
+			}
+			results <- serverResult{server: srv, err: err}
+		}()
+	}
+
+	// Wait until every listener either started or failed
+	var firstErr error
+	running := 0
+	for pending := len(g.servers); pending > 0; pending-- {
+		r := <-results
+		if r.started {
+			running++
+			g.logger.Info("Started", "addr", r.server.addr(), "net", r.server.network())
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s/%s: %w", r.server.addr(), r.server.network(), r.err)
+		}
+	}
+	if firstErr != nil {
+		g.shutdown(results, running)
+		return firstErr
+	}
+
+	select {
+	case sig := <-stop:
+		g.logger.Info("Shutting down", "signal", sig)
+	case r := <-results:
+		firstErr = fmt.Errorf("%s/%s: %w", r.server.addr(), r.server.network(), r.err)
+		running--
+	}
+	g.shutdown(results, running)
+	return firstErr
+}
+
+// shutdown stops all listeners and waits for running ones to exit
+func (g *ServerGroup) shutdown(results <-chan serverResult, running int) {
+	for _, srv := range g.servers {
+		srv.shutdown()
+	}
+	for ; running > 0; running-- {
+		<-results
+	}
+}
+
+// writeMsg sends the response, truncating it to the client's advertised
+// buffer size on UDP so that the client retries over TCP.
+func writeMsg(w dns.ResponseWriter, req, resp *dns.Msg) error {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	return w.WriteMsg(resp)
+}
@@ -0,0 +1,287 @@
+package main
+
+// Static records answered without upstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of static records without own TTL
+const staticTTL = 3600
+
+// Longest chain of static CNAMEs followed in one answer, longer chains
+// (loops) get SERVFAIL
+const maxCNAMEChain = 8
+
+// records builds resource records of the entry. Owner of the records is
+// the name, answers get the queried name instead.
+func (e StaticEntry) records(name string) ([]dns.RR, error) {
+	name = dns.Fqdn(name)
+	ttl := e.TTL
+	if ttl == 0 {
+		ttl = staticTTL
+	}
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	var rrs []dns.RR
+	for _, s := range e.A {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || !ip.Is4() {
+			return nil, fmt.Errorf("%q is not an IPv4 address", s)
+		}
+		rrs = append(rrs, &dns.A{Hdr: hdr(dns.TypeA), A: ip.AsSlice()})
+	}
+	for _, s := range e.AAAA {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || !ip.Is6() || ip.Is4In6() {
+			return nil, fmt.Errorf("%q is not an IPv6 address", s)
+		}
+		rrs = append(rrs, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip.AsSlice()})
+	}
+	if e.CNAME != "" {
+		if len(rrs) > 0 || len(e.TXT) > 0 || len(e.MX) > 0 || len(e.SRV) > 0 {
+			return nil, fmt.Errorf("cname can't be combined with other records")
+		}
+		if _, ok := dns.IsDomainName(e.CNAME); !ok {
+			return nil, fmt.Errorf("%q is not a domain name", e.CNAME)
+		}
+		rrs = append(rrs, &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: dns.Fqdn(e.CNAME)})
+	}
+	for _, s := range e.TXT {
+		rrs = append(rrs, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: splitTXT(s)})
+	}
+	for _, s := range e.MX {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN MX %s", name, ttl, s))
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("mx %q must be \"preference host\"", s)
+		}
+		rrs = append(rrs, rr)
+	}
+	for _, s := range e.SRV {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN SRV %s", name, ttl, s))
+		if err != nil || rr == nil {
+			return nil, fmt.Errorf("srv %q must be \"priority weight port target\"", s)
+		}
+		rrs = append(rrs, rr)
+	}
+	if len(rrs) == 0 {
+		return nil, fmt.Errorf("no records")
+	}
+	return rrs, nil
+}
+
+// records reads the file. Records are grouped by normalized owner name.
+func (f StaticFile) records() (map[string][]dns.RR, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch f.Format {
+	case "", "hosts":
+		if f.Origin != "" {
+			return nil, fmt.Errorf("origin is allowed only for zone files")
+		}
+		return readHosts(file)
+	case "zone":
+		return readZone(file, f.Origin)
+	}
+	return nil, fmt.Errorf("format %q must be one of 'hosts/zone'", f.Format)
+}
+
+// readHosts parses hosts file: address followed by names on every line.
+// IPv4 addresses become A records and are translated like static ones.
+func readHosts(r io.Reader) (map[string][]dns.RR, error) {
+	records := make(map[string][]dns.RR)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: no names for %s", line, fields[0])
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %q is not an address", line, fields[0])
+		}
+		ip = ip.WithZone("").Unmap()
+		for _, name := range fields[1:] {
+			if err := checkStaticName(name); err != nil {
+				return nil, fmt.Errorf("line %d: %q: %s", line, name, err)
+			}
+			hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: staticTTL}
+			var rr dns.RR
+			if ip.Is4() {
+				hdr.Rrtype = dns.TypeA
+				rr = &dns.A{Hdr: hdr, A: ip.AsSlice()}
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rr = &dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()}
+			}
+			n := normalizeDomain(name)
+			records[n] = append(records[n], rr)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// readZone parses master zone file (RFC 1035). Relative names are
+// completed with origin, root by default.
+func readZone(r io.Reader, origin string) (map[string][]dns.RR, error) {
+	records := make(map[string][]dns.RR)
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		n := normalizeDomain(rr.Header().Name)
+		records[n] = append(records[n], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// loadStaticFiles reads the files. Records of the same name from
+// several files are merged.
+func loadStaticFiles(files []StaticFile) (map[string][]dns.RR, error) {
+	all := make(map[string][]dns.RR)
+	for _, f := range files {
+		records, err := f.records()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		for name, rrs := range records {
+			all[name] = append(all[name], rrs...)
+		}
+	}
+	return all, nil
+}
+
+// splitTXT splits text into strings of at most 255 bytes
+func splitTXT(s string) (txt []string) {
+	for len(s) > 255 {
+		txt = append(txt, s[:255])
+		s = s[255:]
+	}
+	return append(txt, s)
+}
+
+// checkStaticName returns error if the name can't be a static owner.
+// Wildcard is allowed only as the leftmost label.
+func checkStaticName(name string) error {
+	n := normalizeDomain(name)
+	if n == "" {
+		return fmt.Errorf("empty name")
+	}
+	if strings.Contains(strings.TrimPrefix(n, "*."), "*") {
+		return fmt.Errorf("wildcard must be the leftmost label")
+	}
+	if _, ok := dns.IsDomainName(n); !ok {
+		return fmt.Errorf("not a domain name")
+	}
+	return nil
+}
+
+// getStatic returns records of the name. Exact name is preferred to the
+// wildcard of the closest enclosing domain.
+func (proxy *DNSProxy) getStatic(name string) ([]dns.RR, bool) {
+	if rrs, ok := proxy.static.Get(name); ok {
+		return rrs, true
+	}
+	for n := normalizeDomain(name); ; {
+		i := strings.IndexByte(n, '.')
+		if i < 0 {
+			return nil, false
+		}
+		n = n[i+1:]
+		if rrs, ok := proxy.static.Get("*." + n); ok {
+			return rrs, true
+		}
+	}
+}
+
+// processStatic answers the question from static records. CNAMEs are
+// followed, the target not found in static is resolved as usual.
+// Missing type gives NODATA.
+func (proxy *DNSProxy) processStatic(q *dns.Question, requestMsg *dns.Msg) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetReply(requestMsg)
+	msg.RecursionAvailable = true
+
+	name := q.Name
+	for i := 0; i < maxCNAMEChain; i++ {
+		rrs, ok := proxy.getStatic(name)
+		if !ok {
+			queryMsg := new(dns.Msg)
+			requestMsg.CopyTo(queryMsg)
+			queryMsg.Question = []dns.Question{{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}}
+			resp, err := proxy.getResponse(queryMsg, new(QueryRecord))
+			if err != nil {
+				return nil, err
+			}
+			msg.Rcode = resp.Rcode
+			msg.Answer = append(msg.Answer, resp.Answer...)
+			msg.Ns = resp.Ns
+			return msg, nil
+		}
+
+		answer, target, err := proxy.staticAnswer(rrs, name, q.Qtype)
+		if err != nil {
+			return nil, err
+		}
+		msg.Answer = append(msg.Answer, answer...)
+		if target == "" {
+			return msg, nil
+		}
+		name = target
+	}
+	return nil, fmt.Errorf("static cname chain of %s is too long", q.Name)
+}
+
+// staticAnswer selects records of qtype named as the query. IPv4
+// addresses are translated for AAAA queries. CNAME is returned with
+// its target for any other type.
+func (proxy *DNSProxy) staticAnswer(rrs []dns.RR, name string, qtype uint16) (answer []dns.RR, target string, err error) {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			return []dns.RR{rr}, cname.Target, nil
+		}
+	}
+
+	for _, rr := range rrs {
+		if a, ok := rr.(*dns.A); ok {
+			if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+				v4, _ := netip.AddrFromSlice(a.A)
+				ip, err := proxy.MakeFakeIP(name, v4)
+				if err != nil {
+					return nil, "", err
+				}
+				answer = append(answer, proxy.newAAAA(name, ip, a.Hdr.Ttl))
+			}
+			if proxy.strictIPv6 || qtype == dns.TypeAAAA {
+				continue
+			}
+		}
+		if qtype != dns.TypeANY && qtype != rr.Header().Rrtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		answer = append(answer, rr)
+	}
+	return answer, "", nil
+}
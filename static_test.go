@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newStaticProxy builds proxy of the config text with upstream answering
+// A queries with 192.0.2.1
+func newStaticProxy(t *testing.T, config string) *DNSProxy {
+	t.Helper()
+	upstream := startUDPServer(t, answerA)
+	cfg, err := parseConfig(t, reloadConfig(upstream)+config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewDNSProxy(cfg, nil, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// formatAnswer formats answer section as "name type data" lines
+func formatAnswer(msg *dns.Msg) string {
+	lines := make([]string, len(msg.Answer))
+	for i, rr := range msg.Answer {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		lines[i] = fmt.Sprintf("%s %s %s", rr.Header().Name, dns.TypeToString[rr.Header().Rrtype], data)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestStaticAnswers(t *testing.T) {
+	var chain []string
+	// 7 CNAMEs to the address fit the limit, 8 don't
+	for i := 1; i <= 8; i++ {
+		chain = append(chain, fmt.Sprintf("  c%d.test: {cname: c%d.test}", i, i+1))
+	}
+	proxy := newStaticProxy(t, `
+static:
+  host.test: 10.0.0.1
+  "*.wild.test": 10.0.0.2
+  exact.wild.test: 10.0.0.3
+  v6.test: 2001:db8::1
+  txt.test: {txt: hello}
+  alias.test: {cname: host.test}
+  out.test: {cname: upstream.example}
+  loop1.test: {cname: loop2.test}
+  loop2.test: {cname: loop1.test}
+  c9.test: 10.0.0.9
+`+strings.Join(chain, "\n")+"\n")
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  string
+	}{
+		{"host.test.", dns.TypeA, dns.RcodeSuccess, "host.test. A 10.0.0.1"},
+		{"HOST.test.", dns.TypeA, dns.RcodeSuccess, "HOST.test. A 10.0.0.1"},
+		{"host.test.", dns.TypeAAAA, dns.RcodeSuccess, "host.test. AAAA 300:dada:feda:f443:ff:0:a00:1"},
+		{"v6.test.", dns.TypeAAAA, dns.RcodeSuccess, "v6.test. AAAA 2001:db8::1"},
+		// Missing types are NODATA, not forwarded
+		{"host.test.", dns.TypeMX, dns.RcodeSuccess, ""},
+		{"txt.test.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"txt.test.", dns.TypeTXT, dns.RcodeSuccess, "txt.test. TXT \"hello\""},
+		// Exact name beats the wildcard, apex doesn't match it
+		{"a.wild.test.", dns.TypeA, dns.RcodeSuccess, "a.wild.test. A 10.0.0.2"},
+		{"b.a.wild.test.", dns.TypeA, dns.RcodeSuccess, "b.a.wild.test. A 10.0.0.2"},
+		{"exact.wild.test.", dns.TypeA, dns.RcodeSuccess, "exact.wild.test. A 10.0.0.3"},
+		{"wild.test.", dns.TypeA, dns.RcodeSuccess, "wild.test. A 192.0.2.1"},
+		{"alias.test.", dns.TypeA, dns.RcodeSuccess, "alias.test. CNAME host.test.\nhost.test. A 10.0.0.1"},
+		{"alias.test.", dns.TypeCNAME, dns.RcodeSuccess, "alias.test. CNAME host.test."},
+		// Target outside static is resolved upstream
+		{"out.test.", dns.TypeA, dns.RcodeSuccess, "out.test. CNAME upstream.example.\nupstream.example. A 192.0.2.1"},
+		{"loop1.test.", dns.TypeA, dns.RcodeServerFailure, ""},
+		{"c2.test.", dns.TypeA, dns.RcodeSuccess, "c2.test. CNAME c3.test.\nc3.test. CNAME c4.test.\nc4.test. CNAME c5.test.\n" +
+			"c5.test. CNAME c6.test.\nc6.test. CNAME c7.test.\nc7.test. CNAME c8.test.\nc8.test. CNAME c9.test.\nc9.test. A 10.0.0.9"},
+		{"c1.test.", dns.TypeA, dns.RcodeServerFailure, ""},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		rec := new(QueryRecord)
+		resp, _ := proxy.getResponse(req, rec)
+		if resp.Rcode != tt.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if got := formatAnswer(resp); got != tt.want {
+			t.Errorf("%s %s: answer\n%s\nwant\n%s", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
+
+func TestStaticEntryRecords(t *testing.T) {
+	tests := []struct {
+		entry StaticEntry
+		err   string
+	}{
+		{StaticEntry{A: stringList{"10.0.0.1"}, AAAA: stringList{"2001:db8::1"}, MX: stringList{"10 mx.test"}}, ""},
+		{StaticEntry{SRV: stringList{"0 5 5060 sip.test"}, TXT: stringList{strings.Repeat("x", 300)}}, ""},
+		{StaticEntry{A: stringList{"2001:db8::1"}}, "is not an IPv4 address"},
+		{StaticEntry{AAAA: stringList{"::ffff:10.0.0.1"}}, "is not an IPv6 address"},
+		{StaticEntry{A: stringList{"10.0.0.1"}, CNAME: "host.test"}, "cname can't be combined"},
+		{StaticEntry{MX: stringList{"mx.test"}}, "must be \"preference host\""},
+		{StaticEntry{SRV: stringList{"5060 sip.test"}}, "must be \"priority weight port target\""},
+		{StaticEntry{}, "no records"},
+	}
+	for _, tt := range tests {
+		_, err := tt.entry.records("name.test")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: error %v, want %q", tt.entry, err, tt.err)
+		}
+	}
+}
+
+func TestReadHosts(t *testing.T) {
+	tests := []struct {
+		text, want, err string
+	}{
+		{"# comment\n\n10.0.0.1 a.test B.test # alias\n2001:db8::1%eth0 a.test\n::ffff:10.0.0.2 c.test\n",
+			"a.test. A 10.0.0.1\na.test. AAAA 2001:db8::1\nB.test. A 10.0.0.1\nc.test. A 10.0.0.2", ""},
+		{"10.0.0.1 a.test\n10.0.0.2\n", "", "line 2: no names for 10.0.0.2"},
+		{"host 10.0.0.1\n", "", `line 1: "host" is not an address`},
+		{"10.0.0.1 a.*.test\n", "", `line 1: "a.*.test": wildcard must be the leftmost label`},
+	}
+	for _, tt := range tests {
+		records, err := readHosts(strings.NewReader(tt.text))
+		checkRecords(t, tt.text, records, err, tt.want, tt.err)
+	}
+}
+
+func TestReadZone(t *testing.T) {
+	tests := []struct {
+		text, origin, want, err string
+	}{
+		{"@ 60 IN A 10.0.0.1\nwww 60 IN CNAME @\nabs.example. 60 IN TXT x\n", "zone.test",
+			"abs.example. TXT \"x\"\nwww.zone.test. CNAME zone.test.\nzone.test. A 10.0.0.1", ""},
+		{"$ORIGIN other.test.\nhost 60 IN AAAA 2001:db8::1\n", "",
+			"host.other.test. AAAA 2001:db8::1", ""},
+		{"host 60 IN A 10.0.0.300\n", "zone.test", "", "bad A"},
+		{"host 60 IN BOGUS x\n", "zone.test", "", "unknown RR type"},
+	}
+	for _, tt := range tests {
+		records, err := readZone(strings.NewReader(tt.text), tt.origin)
+		checkRecords(t, tt.text, records, err, tt.want, tt.err)
+	}
+}
+
+// checkRecords compares records sorted by name with want or error with err
+func checkRecords(t *testing.T, input string, records map[string][]dns.RR, err error, want, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%q: error %v, want %q", input, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%q: %s", input, err)
+		return
+	}
+	msg := new(dns.Msg)
+	for _, name := range mapKeys(records) {
+		msg.Answer = append(msg.Answer, records[name]...)
+	}
+	if got := formatAnswer(msg); got != want {
+		t.Errorf("%q: records\n%s\nwant\n%s", input, got, want)
+	}
+}
+
+// Records of a name are merged from all files, inline static entries
+// replace them
+func TestLoadStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	zone := filepath.Join(dir, "zone")
+	bad := filepath.Join(dir, "bad")
+	writeFile(t, hosts, "10.0.0.1 a.test b.test\n")
+	writeFile(t, zone, "a 60 IN TXT zone\nb 60 IN TXT zone\n")
+	writeFile(t, bad, "10.0.0.1\n")
+
+	records, err := loadStaticFiles([]StaticFile{{Path: hosts}, {Path: zone, Format: "zone", Origin: "test"}})
+	checkRecords(t, "files", records, err,
+		"a.test. A 10.0.0.1\na.test. TXT \"zone\"\nb.test. A 10.0.0.1\nb.test. TXT \"zone\"", "")
+
+	_, err = loadStaticFiles([]StaticFile{{Path: hosts}, {Path: bad}})
+	if err == nil || !strings.HasPrefix(err.Error(), bad+": line 1:") {
+		t.Errorf("error %v, want line of %s", err, bad)
+	}
+	_, err = loadStaticFiles([]StaticFile{{Path: hosts, Origin: "test"}})
+	if err == nil || !strings.Contains(err.Error(), "origin is allowed only for zone files") {
+		t.Errorf("error %v, want origin error", err)
+	}
+
+	proxy := newStaticProxy(t, fmt.Sprintf(`
+static-files:
+  - %s
+  - {path: %s, format: zone, origin: test}
+static:
+  b.test: 10.0.0.2
+`, hosts, zone))
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string
+	}{
+		{"a.test.", dns.TypeA, "a.test. A 10.0.0.1"},
+		{"a.test.", dns.TypeTXT, "a.test. TXT \"zone\""},
+		{"b.test.", dns.TypeA, "b.test. A 10.0.0.2"},
+		{"b.test.", dns.TypeTXT, ""},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		resp, err := proxy.getResponse(req, new(QueryRecord))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatAnswer(resp); got != tt.want {
+			t.Errorf("%s %s: answer\n%s\nwant\n%s", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
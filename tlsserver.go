@@ -0,0 +1,222 @@
+package main
+
+// DNS-over-TLS and DNS-over-HTTPS listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Path of DNS-over-HTTPS queries
+const dohPath = "/dns-query"
+
+// Certificate files are checked for changes not more often than this
+const certCheckInterval = 10 * time.Second
+
+// CertStore serves certificate for TLS listeners and reloads it when
+// the files change. On reload error the old certificate stays in use.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	logger   *Log
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func NewCertStore(certFile, keyFile string, logger *Log) (*CertStore, error) {
+	s := &CertStore{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lastModified returns the latest modification time of the files
+func (s *CertStore) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{s.certFile, s.keyFile} {
+		st, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if st.ModTime().After(last) {
+			last = st.ModTime()
+		}
+	}
+	return last, nil
+}
+
+func (s *CertStore) load() error {
+	modTime, err := s.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.cert, s.modTime, s.checked = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading changed files
+func (s *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checked) < certCheckInterval {
+		return s.cert, nil
+	}
+	s.checked = time.Now()
+	if modTime, err := s.lastModified(); err != nil || modTime.Equal(s.modTime) {
+		return s.cert, nil
+	}
+	if err := s.load(); err != nil {
+		s.logger.Error("Certificate reload failed, old one is used", "cert", s.certFile, "err", err)
+		return s.cert, nil
+	}
+	s.logger.Info("Certificate reloaded", "cert", s.certFile)
+	return s.cert, nil
+}
+
+// TLSConfig returns server settings using the store
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate, MinVersion: tls.VersionTLS12}
+}
+
+// httpsListener serves DNS-over-HTTPS (RFC 8484) with the DNS handler
+type httpsListener struct {
+	server *http.Server
+}
+
+func newHTTPSListener(addr string, config *tls.Config, handler dns.Handler) *httpsListener {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, dohHandler{handler})
+	return &httpsListener{server: &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         config,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}}
+}
+
+func (l *httpsListener) serve(started func()) error {
+	ln, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return err
+	}
+	started()
+	return l.server.ServeTLS(ln, "", "")
+}
+
+func (l *httpsListener) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l.server.Shutdown(ctx)
+}
+
+func (l *httpsListener) addr() string    { return l.server.Addr }
+func (l *httpsListener) network() string { return "https" }
+
+type dohHandler struct {
+	handler dns.Handler
+}
+
+func (h dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(buf)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad query: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohWriter{local: localAddr(r), remote: remoteAddr(r)}
+	h.handler.ServeDNS(rw, req)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusBadRequest)
+		return
+	}
+	out, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rw.msg)))
+	w.Write(out)
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// dohWriter keeps the response of DNS handler
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
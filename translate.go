@@ -0,0 +1,168 @@
+package main
+
+// IPv4-embedded IPv6 addresses, RFC 6052
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// uOctet is the byte (bits 64-71) that must be zero in the RFC 6052 layout
+const uOctet = 8
+
+// parsePrefix parses translation prefix. Plain address (without length)
+// means /96 for compatibility with old configs.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		s += "/96"
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, err
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Addr().IsUnspecified() {
+		return prefix, fmt.Errorf("prefix must be IPv6: %s", s)
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return prefix, fmt.Errorf("prefix length must be one of 32, 40, 48, 56, 64 or 96: %s", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// embedIPv4 places IPv4 address into prefix skipping the "u" octet
+func embedIPv4(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	ip := prefix.Addr().As16()
+	b := v4.Unmap().As4()
+	for i, j := prefix.Bits()/8, 0; j < len(b); i++ {
+		if i == uOctet {
+			ip[i] = 0
+			continue
+		}
+		ip[i] = b[j]
+		j++
+	}
+	return netip.AddrFrom16(ip)
+}
+
+// extractIPv4 gets IPv4 address embedded into ip with prefix
+func extractIPv4(prefix netip.Prefix, ip netip.Addr) (netip.Addr, error) {
+	if !prefix.Contains(ip) {
+		return netip.Addr{}, fmt.Errorf("address doesn't have our prefix")
+	}
+	b := ip.As16()
+	var v4 [4]byte
+	for i, j := prefix.Bits()/8, 0; j < len(v4); i++ {
+		if i == uOctet {
+			if b[i] != 0 {
+				return netip.Addr{}, fmt.Errorf("non-zero u octet in %s", ip)
+			}
+			continue
+		}
+		v4[j] = b[i]
+		j++
+	}
+	return netip.AddrFrom4(v4), nil
+}
+
+type prefixRule struct {
+	prefix   netip.Prefix
+	domains  []string
+	networks []netip.Prefix
+}
+
+// Translator maps IPv4 addresses into IPv6 prefixes and back. Prefix is
+// selected by destination name or IPv4 address: rules are checked in
+// order, the first match wins. Prefixes must not overlap, otherwise
+// address could be extracted with the wrong one. Translator is
+// immutable, so it is safe for concurrent use.
+type Translator struct {
+	rules []prefixRule
+	def   netip.Prefix
+	// all prefixes, longest first
+	all []netip.Prefix
+}
+
+func NewTranslator(def string, rules []PrefixRule) (*Translator, error) {
+	var err error
+	t := new(Translator)
+	if t.def, err = parsePrefix(def); err != nil {
+		return nil, err
+	}
+	t.all = append(t.all, t.def)
+
+	for _, r := range rules {
+		var rule prefixRule
+		if rule.prefix, err = parsePrefix(r.Prefix); err != nil {
+			return nil, err
+		}
+		for _, d := range r.Domains {
+			rule.domains = append(rule.domains, normalizeDomain(d))
+		}
+		for _, n := range r.Networks {
+			network, err := netip.ParsePrefix(n)
+			if err != nil {
+				return nil, err
+			}
+			if !network.Addr().Is4() {
+				return nil, fmt.Errorf("network must be IPv4: %s", n)
+			}
+			rule.networks = append(rule.networks, network.Masked())
+		}
+		if len(rule.domains) == 0 && len(rule.networks) == 0 {
+			return nil, fmt.Errorf("prefix %s has neither domains nor networks", r.Prefix)
+		}
+		for _, prefix := range t.all {
+			if prefix.Overlaps(rule.prefix) {
+				return nil, fmt.Errorf("prefix %s overlaps %s", rule.prefix, prefix)
+			}
+		}
+		t.rules = append(t.rules, rule)
+		t.all = append(t.all, rule.prefix)
+	}
+
+	sort.SliceStable(t.all, func(i, j int) bool {
+		return t.all[i].Bits() > t.all[j].Bits()
+	})
+	return t, nil
+}
+
+// Select returns prefix for the name and IPv4 address
+func (t *Translator) Select(name string, v4 netip.Addr) netip.Prefix {
+	name = normalizeDomain(name)
+	v4 = v4.Unmap()
+	for _, r := range t.rules {
+		for _, d := range r.domains {
+			if inDomain(name, d) {
+				return r.prefix
+			}
+		}
+		for _, n := range r.networks {
+			if n.Contains(v4) {
+				return r.prefix
+			}
+		}
+	}
+	return t.def
+}
+
+// Embed returns IPv6 address for IPv4 address of the name
+func (t *Translator) Embed(name string, v4 netip.Addr) (netip.Addr, error) {
+	if !v4.Unmap().Is4() {
+		return netip.Addr{}, fmt.Errorf("%s is not IPv4", v4)
+	}
+	return embedIPv4(t.Select(name, v4), v4), nil
+}
+
+// Extract gets IPv4 address from ip built with any of prefixes
+func (t *Translator) Extract(ip netip.Addr) (netip.Addr, error) {
+	for _, prefix := range t.all {
+		if prefix.Contains(ip) {
+			return extractIPv4(prefix, ip)
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("address doesn't have our prefix")
+}
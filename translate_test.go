@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/miekg/dns"
+)
+
+var prefixLengths = []int{32, 40, 48, 56, 64, 96}
+
+// RFC 6052 section 2.4, IPv4 address 192.0.2.33
+func TestEmbedRFC6052Examples(t *testing.T) {
+	tests := []struct {
+		prefix, ip string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	}
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for _, tt := range tests {
+		tr, err := NewTranslator(tt.prefix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, err := tr.Embed("example.", v4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := netip.MustParseAddr(tt.ip); ip != want {
+			t.Errorf("%s: embedded %s, want %s", tt.prefix, ip, want)
+		}
+		back, err := tr.Extract(ip)
+		if err != nil || back != v4 {
+			t.Errorf("%s: extracted %s (%v), want %s", tt.prefix, back, err, v4)
+		}
+	}
+}
+
+// Any IPv4 address embedded into any prefix is extracted back, the prefix
+// is kept and bits 64-71 stay zero
+func TestEmbedExtractRoundTrip(t *testing.T) {
+	for _, bits := range prefixLengths {
+		bits := bits
+		t.Run(fmt.Sprintf("/%d", bits), func(t *testing.T) {
+			property := func(p [16]byte, b [4]byte) bool {
+				prefix, err := parsePrefix(fmt.Sprintf("%s/%d", netip.AddrFrom16(p), bits))
+				if err != nil {
+					// Not an allowed prefix, like ::ffff:0:0/96
+					return true
+				}
+				tr, err := NewTranslator(prefix.String(), nil)
+				if err != nil {
+					t.Log(err)
+					return false
+				}
+				v4 := netip.AddrFrom4(b)
+				ip, err := tr.Embed("example.", v4)
+				if err != nil {
+					t.Log(err)
+					return false
+				}
+				// With /96 the u octet is a part of the prefix
+				if bits <= 64 && ip.As16()[uOctet] != 0 || !prefix.Contains(ip) {
+					t.Logf("%s in %s: bad layout %s", v4, prefix, ip)
+					return false
+				}
+				back, err := tr.Extract(ip)
+				if err != nil || back != v4 {
+					t.Logf("%s in %s: extracted %s (%v)", v4, prefix, back, err)
+					return false
+				}
+				return true
+			}
+			if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExtractNonZeroUOctet(t *testing.T) {
+	tr, err := NewTranslator("2001:db8:100::/40", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Extract(netip.MustParseAddr("2001:db8:1c0:2:ff21::")); err == nil {
+		t.Error("address with non-zero u octet extracted")
+	}
+}
+
+func TestNewTranslatorOverlap(t *testing.T) {
+	rules := []PrefixRule{{Prefix: "300:dada:feda:f443:ff::/96", Domains: []string{"x"}}}
+	if _, err := NewTranslator("300:dada:feda:f443::/64", rules); err == nil {
+		t.Error("overlapping prefixes accepted")
+	}
+}
+
+// Translator is shared by queries, run with -race
+func TestTranslatorConcurrent(t *testing.T) {
+	rules := []PrefixRule{
+		{Prefix: "300:1::/32", Domains: []string{"corp.test"}},
+		{Prefix: "300:2::/56", Networks: []string{"10.0.0.0/8"}},
+	}
+	tr, err := NewTranslator("300:dada:feda:f443:ff::", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &DNSProxy{translator: tr}
+	names := []string{"a.corp.test.", "b.example.", "c.test."}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				v4 := netip.AddrFrom4([4]byte{byte(g), 0, byte(i >> 8), byte(i)})
+				ip, err := tr.Embed(names[i%len(names)], v4)
+				if err != nil {
+					errs <- err
+					return
+				}
+				ptr, err := dns.ReverseAddr(ip.String())
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, extract := range []func() (netip.Addr, error){
+					func() (netip.Addr, error) { return tr.Extract(ip) },
+					func() (netip.Addr, error) { return proxy.ReversePTR(ptr) },
+				} {
+					if back, err := extract(); err != nil || back != v4 {
+						errs <- fmt.Errorf("%s -> %s -> %s (%v)", v4, ip, back, err)
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+// Upstream connections. Connections are kept open and shared by
+// concurrent queries: every query gets a random ID unique on the
+// connection and responses are matched back by ID and question.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UDP socket is replaced after this number of queries, so source port
+// doesn't stay the same for long
+const udpMaxQueries = 256
+
+var errConnClosed = errors.New("connection closed")
+
+// plainTransport is UDP with TCP retry on truncation
+type plainTransport struct {
+	addr string
+	udp  *connPool
+	tcp  *connPool
+}
+
+func newPlainTransport(addr string, cfg UpstreamConfig) *plainTransport {
+	dialer := func(network string) func(time.Duration) (net.Conn, error) {
+		return func(timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		}
+	}
+	return &plainTransport{
+		addr: addr,
+		udp:  newConnPool(dialer("udp"), cfg.Connections, udpMaxQueries, cfg.IdleTimeout),
+		tcp:  newConnPool(dialer("tcp"), cfg.Connections, 0, cfg.IdleTimeout),
+	}
+}
+
+func (t *plainTransport) Exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := t.udp.Exchange(m, timeout)
+	metrics.ObserveUpstream(t.addr, start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Truncated answer. Ask the same server over TCP
+	if resp.Truncated {
+		start = time.Now()
+		resp, err = t.tcp.Exchange(m, timeout)
+		metrics.ObserveUpstream(t.addr, start, err)
+	}
+	return resp, err
+}
+
+func (t *plainTransport) Close() {
+	t.udp.Close()
+	t.tcp.Close()
+}
+
+// connPool keeps up to size connections to one server. A query goes to
+// the least loaded connection; a new one is opened only when all are busy.
+type connPool struct {
+	dial       func(timeout time.Duration) (net.Conn, error)
+	size       int
+	maxQueries int
+	idle       time.Duration
+
+	mu      sync.Mutex
+	conns   []*pipeConn
+	dialing chan struct{} // closed when the dial in progress ends
+	closed  bool
+}
+
+func newConnPool(dial func(time.Duration) (net.Conn, error), size, maxQueries int, idle time.Duration) *connPool {
+	if size < 1 {
+		size = 1
+	}
+	return &connPool{dial: dial, size: size, maxQueries: maxQueries, idle: idle}
+}
+
+func (p *connPool) Exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	c, reused, err := p.get(timeout)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.exchange(m, timeout)
+	// Server may have closed idle connection, try a fresh one
+	if errors.Is(err, errConnClosed) && reused {
+		if c, _, err = p.get(timeout); err == nil {
+			resp, err = c.exchange(m, timeout)
+		}
+	}
+	return resp, err
+}
+
+// get returns connection for the next query, dialing a new one if needed.
+// Dial runs without the lock, one at a time: queries use existing
+// connections meanwhile, only those without any wait for the dial.
+func (p *connPool) get(timeout time.Duration) (c *pipeConn, reused bool, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, false, errConnClosed
+		}
+		c, load := p.leastLoaded()
+		if c != nil && (load == 0 || len(p.conns) >= p.size || p.dialing != nil) {
+			p.mu.Unlock()
+			return c, true, nil
+		}
+		if wait := p.dialing; wait != nil {
+			p.mu.Unlock()
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case <-wait:
+				timer.Stop()
+				continue
+			case <-timer.C:
+				return nil, false, fmt.Errorf("dial: i/o timeout")
+			}
+		}
+		done := make(chan struct{})
+		p.dialing = done
+		p.mu.Unlock()
+
+		conn, err := p.dial(time.Until(deadline))
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.dialing = nil
+		close(done)
+		if err == nil && p.closed {
+			conn.Close()
+			err = errConnClosed
+		}
+		if err != nil {
+			if c, _ := p.leastLoaded(); c != nil {
+				return c, true, nil
+			}
+			return nil, false, err
+		}
+		c = newPipeConn(conn, p.maxQueries, p.idle)
+		p.conns = append(p.conns, c)
+		return c, false, nil
+	}
+}
+
+// leastLoaded drops connections taking no more queries and returns the
+// least loaded one with number of its queries in flight
+func (p *connPool) leastLoaded() (c *pipeConn, load int) {
+	conns := p.conns[:0]
+	load = -1
+	for _, conn := range p.conns {
+		n, ok := conn.load()
+		if !ok {
+			continue
+		}
+		conns = append(conns, conn)
+		if load < 0 || n < load {
+			c, load = conn, n
+		}
+	}
+	p.conns = conns
+	return
+}
+
+// Close closes all connections
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.close(errConnClosed)
+	}
+	p.conns = nil
+	p.closed = true
+}
+
+type pendingQuery struct {
+	question dns.Question
+	ch       chan *dns.Msg
+}
+
+// pipeConn is a connection with several queries in flight. After
+// maxQueries queries it takes no new ones and closes when drained.
+type pipeConn struct {
+	conn       *dns.Conn
+	packet     bool
+	maxQueries int
+	idle       time.Duration
+	wmu        sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]pendingQuery
+	queries int
+	err     error
+}
+
+func newPipeConn(conn net.Conn, maxQueries int, idle time.Duration) *pipeConn {
+	_, packet := conn.(net.PacketConn)
+	c := &pipeConn{
+		conn:       &dns.Conn{Conn: conn},
+		packet:     packet,
+		maxQueries: maxQueries,
+		idle:       idle,
+		pending:    make(map[uint16]pendingQuery),
+	}
+	go c.read()
+	return c
+}
+
+// load returns number of queries in flight, false if connection can't
+// take more queries
+func (c *pipeConn) load() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending), c.err == nil && (c.maxQueries == 0 || c.queries < c.maxQueries)
+}
+
+// close fails all pending queries
+func (c *pipeConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(err)
+}
+
+func (c *pipeConn) closeLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, p := range c.pending {
+		close(p.ch)
+		delete(c.pending, id)
+	}
+}
+
+// done closes used up connection without queries in flight
+func (c *pipeConn) doneLocked() {
+	if c.maxQueries > 0 && c.queries >= c.maxQueries && len(c.pending) == 0 {
+		c.closeLocked(errConnClosed)
+	}
+}
+
+func (c *pipeConn) read() {
+	var buf []byte
+	if c.packet {
+		buf = make([]byte, dns.MaxMsgSize)
+	}
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		resp, err := c.readMsg(buf)
+		if err != nil {
+			c.close(fmt.Errorf("%w: %s", errConnClosed, err))
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		c.mu.Lock()
+		p, ok := c.pending[resp.Id]
+		if ok && answers(resp, p.question) {
+			delete(c.pending, resp.Id)
+			p.ch <- resp
+			c.doneLocked()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// answers tells if response is for the question
+func answers(resp *dns.Msg, q dns.Question) bool {
+	return len(resp.Question) > 0 && strings.EqualFold(resp.Question[0].Name, q.Name) &&
+		resp.Question[0].Qtype == q.Qtype && resp.Question[0].Qclass == q.Qclass
+}
+
+// readMsg reads the next message. Malformed datagrams are skipped,
+// a broken stream can't be read further.
+func (c *pipeConn) readMsg(buf []byte) (*dns.Msg, error) {
+	if !c.packet {
+		return c.conn.ReadMsg()
+	}
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if m.Unpack(buf[:n]) != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (c *pipeConn) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := dns.Id()
+	for _, busy := c.pending[id]; busy; _, busy = c.pending[id] {
+		id = dns.Id()
+	}
+	c.pending[id] = pendingQuery{question: m.Question[0], ch: ch}
+	c.queries++
+	c.mu.Unlock()
+
+	q := m.Copy()
+	q.Id = id
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.conn.WriteMsg(q)
+	c.wmu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("%w: %s", errConnClosed, err)
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return nil, c.err
+		}
+		resp.Id = m.Id
+		return resp, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.doneLocked()
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%s: i/o timeout", c.conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUDPServer runs DNS server on a random local UDP port
+func startUDPServer(tb testing.TB, handler dns.HandlerFunc) string {
+	tb.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	serve(tb, srv)
+	return pc.LocalAddr().String()
+}
+
+// startTLSServer runs DNS-over-TLS server with self-signed certificate
+// on a random local port. Returns address and SPKI pin of the key.
+func startTLSServer(tb testing.TB, handler dns.HandlerFunc) (addr, pin string) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serve(tb, &dns.Server{Listener: ln, Net: "tcp-tls", Handler: handler})
+	return ln.Addr().String(), base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// serve starts the server and stops it at the end of the test
+func serve(tb testing.TB, srv *dns.Server) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	tb.Cleanup(func() { srv.Shutdown() })
+}
+
+// answerA answers every A query with 192.0.2.1
+func answerA(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+	m.Answer = append(m.Answer, rr)
+	w.WriteMsg(m)
+}
+
+// blockingServer answers "slow." after release is called, entered gets
+// a value when such query arrives
+func blockingServer(t *testing.T) (addr string, entered chan struct{}, release func()) {
+	entered = make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	addr = startUDPServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "slow." {
+			entered <- struct{}{}
+			<-unblock
+		}
+		answerA(w, r)
+	})
+	var once sync.Once
+	release = func() { once.Do(func() { close(unblock) }) }
+	// Server is shut down after the handler returns
+	t.Cleanup(release)
+	return
+}
+
+func query(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	return m
+}
+
+// Slow dial must not block queries which can use an open connection
+func TestConnPoolDialDoesNotBlock(t *testing.T) {
+	addr, slowEntered, releaseSlow := blockingServer(t)
+
+	dialEntered := make(chan struct{}, 1)
+	releaseDial := make(chan struct{})
+	var dials atomic.Int32
+	dial := func(timeout time.Duration) (net.Conn, error) {
+		if dials.Add(1) > 1 {
+			dialEntered <- struct{}{}
+			<-releaseDial
+		}
+		return net.DialTimeout("udp", addr, timeout)
+	}
+	pool := newConnPool(dial, 2, 0, time.Minute)
+	defer pool.Close()
+	defer close(releaseDial)
+
+	// Keep the first connection busy, so the next query dials
+	slow := make(chan error, 1)
+	go func() {
+		_, err := pool.Exchange(query("slow."), 5*time.Second)
+		slow <- err
+	}()
+	<-slowEntered
+	go pool.Exchange(query("dialing."), 5*time.Second)
+	<-dialEntered
+
+	start := time.Now()
+	resp, err := pool.Exchange(query("fast."), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("expected one answer, got %v", resp.Answer)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("query waited %s for the dial", d)
+	}
+	releaseSlow()
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+var benchConfig = UpstreamConfig{Connections: 4, IdleTimeout: time.Minute}
+
+// benchExchange runs parallel queries through exchange
+func benchExchange(b *testing.B, exchange func(*dns.Msg) (*dns.Msg, error)) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := exchange(query("bench.")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Old way: new client and connection for every query
+func BenchmarkUDPClientPerQuery(b *testing.B) {
+	addr := startUDPServer(b, answerA)
+	benchExchange(b, func(m *dns.Msg) (*dns.Msg, error) {
+		c := &dns.Client{Timeout: 2 * time.Second}
+		resp, _, err := c.Exchange(m, addr)
+		return resp, err
+	})
+}
+
+func BenchmarkUDPPlainTransport(b *testing.B) {
+	addr := startUDPServer(b, answerA)
+	t := newPlainTransport(addr, benchConfig)
+	defer t.Close()
+	benchExchange(b, func(m *dns.Msg) (*dns.Msg, error) {
+		return t.Exchange(m, 2*time.Second)
+	})
+}
+
+func BenchmarkTLSClientPerQuery(b *testing.B) {
+	addr, _ := startTLSServer(b, answerA)
+	benchExchange(b, func(m *dns.Msg) (*dns.Msg, error) {
+		c := &dns.Client{Net: "tcp-tls", Timeout: 2 * time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+		resp, _, err := c.Exchange(m, addr)
+		return resp, err
+	})
+}
+
+func BenchmarkTLSTransport(b *testing.B) {
+	addr, pin := startTLSServer(b, answerA)
+	t, err := newTLSTransport(addr, UpstreamServer{SPKI: []string{pin}}, benchConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer t.Close()
+	benchExchange(b, func(m *dns.Msg) (*dns.Msg, error) {
+		return t.Exchange(m, 2*time.Second)
+	})
+}
@@ -0,0 +1,411 @@
+package main
+
+// Upstream groups: server selection, failover and health checking
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Selection strategies of upstream group
+const (
+	StrategyFailover      = "failover"
+	StrategyRoundRobin    = "round-robin"
+	StrategyLowestLatency = "lowest-latency"
+)
+
+var strategies = []string{StrategyFailover, StrategyRoundRobin, StrategyLowestLatency}
+
+var health = NewHealthChecker()
+
+// retireDelay keeps connections of servers removed on reload open for
+// queries still running on the old configuration
+var retireDelay = time.Minute
+
+// transport sends a query to one server
+type transport interface {
+	Exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error)
+}
+
+// parseUpstream splits server address into scheme and host:port.
+// Plain servers have empty scheme. Port defaults by scheme.
+func parseUpstream(addr string) (scheme, hostport string, err error) {
+	hostport = addr
+	port := "53"
+	if i := strings.Index(addr, "://"); i >= 0 {
+		scheme, hostport = addr[:i], addr[i+3:]
+		switch scheme {
+		case "tls":
+			port = "853"
+		case "https":
+			port = "443"
+			u, err := url.Parse(addr)
+			if err != nil {
+				return "", "", fmt.Errorf("%q is not URL", addr)
+			}
+			hostport = u.Host
+		default:
+			return "", "", fmt.Errorf("unknown scheme %q", scheme)
+		}
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+		}
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil || host == "" {
+		return "", "", fmt.Errorf("%q is not host:port", addr)
+	}
+	return scheme, hostport, nil
+}
+
+func newTransport(s UpstreamServer, cfg UpstreamConfig) (transport, error) {
+	scheme, hostport, err := parseUpstream(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	if s.Method != "" && (scheme != "https" || s.Method != "get" && s.Method != "post") {
+		return nil, fmt.Errorf("%s: method must be 'get/post' of https:// server", s.Address)
+	}
+	switch scheme {
+	case "tls":
+		return newTLSTransport(hostport, s, cfg)
+	case "https":
+		// Path of RFC 8484 examples
+		u, _ := url.Parse(s.Address)
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return newHTTPSTransport(u.String(), hostport, s, cfg)
+	}
+	if s.ServerName != "" || len(s.SPKI) > 0 || s.CAFile != "" {
+		return nil, fmt.Errorf("%s: TLS settings need tls:// or https:// server", s.Address)
+	}
+	return newPlainTransport(hostport, cfg), nil
+}
+
+// upstreamKey identifies server with its transport settings
+func upstreamKey(s UpstreamServer, cfg UpstreamConfig) string {
+	s.Timeout = 0
+	return fmt.Sprintf("%+v/%d/%s", s, cfg.Connections, cfg.IdleTimeout)
+}
+
+// upstream keeps health of one server. State is shared by all groups
+// using the server and survives reload.
+type upstream struct {
+	addr      string
+	transport transport
+
+	mu       sync.Mutex
+	fails    int           // consecutive failures
+	ejected  time.Time     // not used until
+	rtt      time.Duration // smoothed round trip time
+	inflight int           // running exchanges
+	retired  bool          // close after the last exchange
+}
+
+// exchange sends the query with the server transport
+func (u *upstream) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	u.mu.Lock()
+	u.inflight++
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.inflight--
+		last := u.retired && u.inflight == 0
+		u.mu.Unlock()
+		if last {
+			u.close()
+		}
+	}()
+	return u.transport.Exchange(m, timeout)
+}
+
+// retire closes the transport when running exchanges are done
+func (u *upstream) retire() {
+	u.mu.Lock()
+	u.retired = true
+	idle := u.inflight == 0
+	u.mu.Unlock()
+	if idle {
+		u.close()
+	}
+}
+
+func (u *upstream) close() {
+	if c, ok := u.transport.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
+
+// observe adds round trip time to the moving average
+func (u *upstream) observe(rtt time.Duration) {
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (7*u.rtt + 3*rtt) / 10
+	}
+}
+
+func (u *upstream) state() (ejected bool, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().Before(u.ejected), u.rtt
+}
+
+// HealthChecker tracks upstream servers. Servers failed max-fails times
+// in a row are ejected for eject-time or until an active probe passes.
+type HealthChecker struct {
+	mu        sync.Mutex
+	cfg       UpstreamConfig
+	upstreams map[string]*upstream
+	logger    *Log
+}
+
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{upstreams: make(map[string]*upstream)}
+}
+
+// Configure applies settings, may be called on reload
+func (h *HealthChecker) Configure(cfg UpstreamConfig, logger *Log) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg = cfg
+	h.logger = logger
+}
+
+func (h *HealthChecker) config() (UpstreamConfig, *Log) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg, h.logger
+}
+
+// get returns the server state, creating it on first use
+func (h *HealthChecker) get(s UpstreamServer, cfg UpstreamConfig) (*upstream, error) {
+	key := upstreamKey(s, cfg)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if u, ok := h.upstreams[key]; ok {
+		return u, nil
+	}
+	t, err := newTransport(s, cfg)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstream{addr: s.Address, transport: t}
+	h.upstreams[key] = u
+	return u, nil
+}
+
+// Retain forgets servers not in the list. Their connections are closed
+// after retireDelay, when queries using them are done.
+func (h *HealthChecker) Retain(servers []UpstreamServer, cfg UpstreamConfig) {
+	keep := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		keep[upstreamKey(s, cfg)] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, u := range h.upstreams {
+		if !keep[key] {
+			time.AfterFunc(retireDelay, u.retire)
+			delete(h.upstreams, key)
+		}
+	}
+}
+
+func (h *HealthChecker) passed(u *upstream, rtt time.Duration) {
+	_, logger := h.config()
+	u.mu.Lock()
+	recovered := !u.ejected.IsZero()
+	u.fails = 0
+	u.ejected = time.Time{}
+	u.observe(rtt)
+	u.mu.Unlock()
+	if recovered && logger != nil {
+		logger.Info("Upstream recovered", "server", u.addr)
+	}
+}
+
+// failed counts the failure and adds the timeout to the smoothed rtt,
+// so dead server doesn't stay the fastest one
+func (h *HealthChecker) failed(u *upstream, timeout time.Duration) {
+	cfg, logger := h.config()
+	u.mu.Lock()
+	u.observe(timeout)
+	u.fails++
+	eject := cfg.MaxFails > 0 && u.fails >= cfg.MaxFails && !time.Now().Before(u.ejected)
+	if eject {
+		u.fails = 0
+		u.ejected = time.Now().Add(cfg.EjectTime)
+	}
+	u.mu.Unlock()
+	if eject {
+		metrics.UpstreamEjections.Inc(u.addr)
+		if logger != nil {
+			logger.Warn("Upstream ejected", "server", u.addr, "for", cfg.EjectTime)
+		}
+	}
+}
+
+// Run probes all known servers every health-check interval.
+// Never returns.
+func (h *HealthChecker) Run() {
+	for {
+		cfg, _ := h.config()
+		if cfg.HealthCheck <= 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		time.Sleep(cfg.HealthCheck)
+
+		h.mu.Lock()
+		list := make([]*upstream, 0, len(h.upstreams))
+		for _, u := range h.upstreams {
+			list = append(list, u)
+		}
+		h.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, u := range list {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				h.probe(u, cfg)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// probe sends NS query for the probe name. Any response means alive.
+func (h *HealthChecker) probe(u *upstream, cfg UpstreamConfig) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(cfg.ProbeName), dns.TypeNS)
+	start := time.Now()
+	if _, err := u.exchange(m, cfg.Timeout); err != nil {
+		_, logger := h.config()
+		if logger != nil {
+			logger.Debug("Probe failed", "server", u.addr, "err", err)
+		}
+		h.failed(u, cfg.Timeout)
+		return
+	}
+	h.passed(u, time.Since(start))
+}
+
+type groupMember struct {
+	*upstream
+	timeout time.Duration
+}
+
+// UpstreamGroup sends queries of one route to its servers
+type UpstreamGroup struct {
+	strategy string
+	members  []groupMember
+	next     uint32
+	logger   *Log
+}
+
+// NewUpstreamGroup builds group from the route. Servers without own
+// timeout use the default one.
+func NewUpstreamGroup(route Upstreams, cfg UpstreamConfig, logger *Log) (*UpstreamGroup, error) {
+	if len(route.Servers) == 0 {
+		return nil, fmt.Errorf("no upstream servers")
+	}
+	g := &UpstreamGroup{strategy: route.Strategy, logger: logger}
+	if g.strategy == "" {
+		g.strategy = StrategyFailover
+	}
+	for _, s := range route.Servers {
+		u, err := health.get(s, cfg)
+		if err != nil {
+			return nil, err
+		}
+		m := groupMember{upstream: u, timeout: s.Timeout}
+		if m.timeout == 0 {
+			m.timeout = cfg.Timeout
+		}
+		g.members = append(g.members, m)
+	}
+	return g, nil
+}
+
+func (g *UpstreamGroup) String() string {
+	addrs := make([]string, len(g.members))
+	for i, m := range g.members {
+		addrs[i] = m.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// order returns servers in order of trying. Ejected servers go last,
+// so they are used only when all others fail.
+func (g *UpstreamGroup) order() []groupMember {
+	var healthy, ejected []groupMember
+	rtts := make(map[*upstream]time.Duration)
+	for _, m := range g.members {
+		out, rtt := m.state()
+		rtts[m.upstream] = rtt
+		if out {
+			ejected = append(ejected, m)
+		} else {
+			healthy = append(healthy, m)
+		}
+	}
+
+	switch g.strategy {
+	case StrategyRoundRobin:
+		if n := len(healthy); n > 1 {
+			i := int(atomic.AddUint32(&g.next, 1) % uint32(n))
+			healthy = append(healthy[i:], healthy[:i]...)
+		}
+	case StrategyLowestLatency:
+		// Servers without measurements go first to get them, failures
+		// count as timeouts
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return rtts[healthy[i].upstream] < rtts[healthy[j].upstream]
+		})
+	}
+	return append(healthy, ejected...)
+}
+
+// Exchange sends the query to servers until one answers. SERVFAIL and
+// REFUSED answers are returned only if no server answers better.
+func (g *UpstreamGroup) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	var fallback *dns.Msg
+	for _, s := range g.order() {
+		start := time.Now()
+		resp, err := s.exchange(m, s.timeout)
+		if err != nil {
+			g.logger.Warn("Upstream failed", "server", s.addr, "name", m.Question[0].Name,
+				"type", dns.TypeToString[m.Question[0].Qtype], "err", err)
+			health.failed(s.upstream, s.timeout)
+			lastErr = err
+			continue
+		}
+		health.passed(s.upstream, time.Since(start))
+		g.logger.Debug("Upstream answered", "server", s.addr, "name", m.Question[0].Name,
+			"type", dns.TypeToString[m.Question[0].Qtype], "rcode", dns.RcodeToString[resp.Rcode],
+			"answers", len(resp.Answer))
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			if fallback == nil {
+				fallback = resp
+			}
+			continue
+		}
+		return resp, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,383 @@
+package main
+
+// Configuration validation. Every problem is reported with the key path
+// and the offending value.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// Validate checks the whole configuration and returns all found problems
+func (c *Config) Validate() error {
+	v := new(validator)
+
+	if c.ListenUDP == "" && c.ListenTCP == "" && c.ListenTLS == "" && c.ListenHTTPS == "" {
+		v.errorf("listen", "required")
+	}
+	v.listenAddr("listen-udp", c.ListenUDP)
+	v.listenAddr("listen-tcp", c.ListenTCP)
+	v.listenAddr("listen-tls", c.ListenTLS)
+	v.listenAddr("listen-https", c.ListenHTTPS)
+	if c.ListenTLS != "" || c.ListenHTTPS != "" {
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			v.errorf("tls", "cert and key are required for listen-tls and listen-https")
+		} else if _, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+			v.errorf("tls", "%s", err)
+		}
+	}
+	v.listenAddr("metrics", c.Metrics)
+
+	if c.Prefix == "" {
+		v.errorf("prefix", "required")
+	} else if _, err := parsePrefix(c.Prefix); err != nil {
+		v.errorf("prefix", "%s", err)
+	}
+	v.prefixRules("prefixes", c.Prefixes)
+	v.prefixOverlaps("prefix", c.Prefix, "prefixes", c.Prefixes)
+
+	if _, _, err := net.ParseCIDR(c.MeshPrefix); err != nil {
+		v.errorf("mesh-prefix", "%q is not a CIDR", c.MeshPrefix)
+	}
+
+	if len(c.Default.Servers) == 0 {
+		v.errorf("default", "required")
+	}
+	c.validateForwarders(v)
+	v.static("static", c.Static)
+	v.staticFiles("static-files", c.StaticFiles)
+
+	if c.Cache.ExpTime < 0 {
+		v.errorf("cache.expiration", "%d is negative", c.Cache.ExpTime)
+	}
+	if c.Cache.PurgeTime < 0 {
+		v.errorf("cache.purge", "%d is negative", c.Cache.PurgeTime)
+	}
+	if c.PTR.ForwardNames && c.PTR.Expiration <= 0 {
+		v.errorf("ptr.expiration", "%d must be positive", c.PTR.Expiration)
+	}
+	if c.PTR.Fallback != "" {
+		if err := checkPTRFallback(c.PTR.Fallback); err != nil {
+			v.errorf("ptr.fallback", "%s", err)
+		}
+	}
+	if c.TTL.Max > 0 && c.TTL.Min > c.TTL.Max {
+		v.errorf("ttl.min", "%d is greater than ttl.max %d", c.TTL.Min, c.TTL.Max)
+	}
+
+	if c.Pool.Range != "" {
+		if _, err := NewPool(c.Pool.Range, c.Pool.Lease.Duration(), ""); err != nil {
+			v.errorf("pool", "%s", err)
+		}
+	}
+
+	if c.RateLimit.Rate < 0 {
+		v.errorf("rate-limit.rate", "%g is negative", c.RateLimit.Rate)
+	}
+	if c.RateLimit.Burst < 0 {
+		v.errorf("rate-limit.burst", "%g is negative", c.RateLimit.Burst)
+	}
+	if c.RateLimit.IPv4Prefix < 0 || c.RateLimit.IPv4Prefix > 32 {
+		v.errorf("rate-limit.ipv4-prefix", "%d is out of range 0-32", c.RateLimit.IPv4Prefix)
+	}
+	if c.RateLimit.IPv6Prefix < 0 || c.RateLimit.IPv6Prefix > 128 {
+		v.errorf("rate-limit.ipv6-prefix", "%d is out of range 0-128", c.RateLimit.IPv6Prefix)
+	}
+
+	v.networks("acl.allow", c.ACL.Allow)
+	v.networks("acl.deny", c.ACL.Deny)
+
+	names := make(map[string]bool)
+	for i := range c.Views {
+		view := &c.Views[i]
+		path := fmt.Sprintf("views[%d]", i)
+		if view.Name != "" {
+			if names[view.Name] {
+				v.errorf(path+".name", "duplicate view %q", view.Name)
+			}
+			names[view.Name] = true
+		}
+		if len(view.Clients) == 0 {
+			v.errorf(path+".clients", "required")
+		}
+		v.networks(path+".clients", view.Clients)
+		v.forwarders(path+".forwarders", view.Forwarders)
+		v.upstreams(path+".default", view.Default)
+		v.static(path+".static", view.Static)
+		v.staticFiles(path+".static-files", view.StaticFiles)
+		if view.Prefix != "" {
+			if _, err := parsePrefix(view.Prefix); err != nil {
+				v.errorf(path+".prefix", "%s", err)
+			}
+		}
+		v.prefixRules(path+".prefixes", view.Prefixes)
+		c.viewPrefixOverlaps(v, path, view)
+	}
+
+	if c.QueryLog.Sink != "" {
+		if err := validateQueryLog(&c.QueryLog); err != nil {
+			v.errorf("query-log", "%s", err)
+		}
+	}
+
+	if _, err := parseLevel(c.LogLevel); err != nil {
+		v.errorf("log-level", "%s", err)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		v.errorf("log-format", "%q must be one of 'text/json'", c.LogFormat)
+	}
+	for _, name := range mapKeys(c.LogLevels) {
+		level := c.LogLevels[name]
+		known := false
+		for _, s := range logSubsystems {
+			known = known || s == name
+		}
+		if !known {
+			v.errorf("log-levels."+name, "unknown subsystem, must be one of %s", strings.Join(logSubsystems, "/"))
+		} else if _, err := parseLevel(level); err != nil {
+			v.errorf("log-levels."+name, "%s", err)
+		}
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func (c *Config) validateForwarders(v *validator) {
+	v.upstreams("default", c.Default)
+	v.forwarders("forwarders", c.Forwarders)
+
+	u := c.Upstream
+	if u.Timeout <= 0 {
+		v.errorf("upstream.timeout", "%s is not positive", u.Timeout)
+	}
+	if u.MaxFails < 0 {
+		v.errorf("upstream.max-fails", "%d is negative", u.MaxFails)
+	}
+	if u.EjectTime < 0 {
+		v.errorf("upstream.eject-time", "%s is negative", u.EjectTime)
+	}
+	if u.Connections < 1 {
+		v.errorf("upstream.connections", "%d is less than 1", u.Connections)
+	}
+	if u.IdleTimeout <= 0 {
+		v.errorf("upstream.idle-timeout", "%s is not positive", u.IdleTimeout)
+	}
+	if u.HealthCheck < 0 {
+		v.errorf("upstream.health-check", "%s is negative", u.HealthCheck)
+	}
+	if _, ok := dns.IsDomainName(u.ProbeName); !ok {
+		v.errorf("upstream.probe-name", "%q is not a domain name", u.ProbeName)
+	}
+}
+
+func (v *validator) forwarders(path string, forwarders map[string]Upstreams) {
+	v.duplicateNames(path, mapKeys(forwarders))
+	for _, domain := range mapKeys(forwarders) {
+		p := fmt.Sprintf("%s[%q]", path, domain)
+		if strings.Trim(domain, ".") == "" {
+			v.errorf(p, "empty domain")
+		}
+		if len(forwarders[domain].Servers) == 0 {
+			v.errorf(p, "no servers")
+		}
+		v.upstreams(p, forwarders[domain])
+	}
+}
+
+// upstreams checks strategy and servers of the route
+func (v *validator) upstreams(path string, route Upstreams) {
+	if route.Strategy != "" {
+		known := false
+		for _, s := range strategies {
+			known = known || s == route.Strategy
+		}
+		if !known {
+			v.errorf(path+".strategy", "%q must be one of %s", route.Strategy, strings.Join(strategies, "/"))
+		}
+	}
+	for i, s := range route.Servers {
+		p := fmt.Sprintf("%s.servers[%d]", path, i)
+		if s.Address == "" {
+			v.errorf(p, "empty address")
+		}
+		v.upstream(p, s)
+		if s.Timeout < 0 {
+			v.errorf(p+".timeout", "%s is negative", s.Timeout)
+		}
+	}
+}
+
+// upstream checks address and TLS settings of upstream server
+func (v *validator) upstream(path string, server UpstreamServer) {
+	if server.Address == "" {
+		return
+	}
+	_, hostport, err := parseUpstream(server.Address)
+	if err != nil {
+		v.errorf(path, "%s", err)
+		return
+	}
+	_, port, _ := net.SplitHostPort(hostport)
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		v.errorf(path, "%q has invalid port", server.Address)
+		return
+	}
+	if _, err := newTransport(server, UpstreamConfig{}); err != nil {
+		v.errorf(path, "%s", err)
+	}
+}
+
+func (v *validator) listenAddr(path, addr string) {
+	if addr == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.errorf(path, "%q is not host:port", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		v.errorf(path, "%q has invalid port", addr)
+	}
+}
+
+func (v *validator) static(path string, static map[string]StaticEntry) {
+	v.duplicateNames(path, mapKeys(static))
+	for _, name := range mapKeys(static) {
+		p := fmt.Sprintf("%s[%q]", path, name)
+		if err := checkStaticName(name); err != nil {
+			v.errorf(p, "%s", err)
+			continue
+		}
+		if _, err := static[name].records(name); err != nil {
+			v.errorf(p, "%s", err)
+		}
+	}
+}
+
+// staticFiles reads every file, so errors of all files are reported
+func (v *validator) staticFiles(path string, files []StaticFile) {
+	for i, f := range files {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if f.Path == "" {
+			v.errorf(p, "path is required")
+			continue
+		}
+		if _, err := f.records(); err != nil {
+			v.errorf(p, "%s: %s", f.Path, err)
+		}
+	}
+}
+
+// duplicateNames reports names equal after normalization, like "Ygg" and ".ygg"
+func (v *validator) duplicateNames(path string, names []string) {
+	seen := make(map[string]string)
+	for _, name := range names {
+		n := normalizeDomain(name)
+		if prev, ok := seen[n]; ok {
+			v.errorf(fmt.Sprintf("%s[%q]", path, name), "duplicates %q", prev)
+		}
+		seen[n] = name
+	}
+}
+
+func (v *validator) networks(path string, list []string) {
+	for i, n := range list {
+		if _, err := parseNetworks([]string{n}); err != nil {
+			v.errorf(fmt.Sprintf("%s[%d]", path, i), "%q is not an address or CIDR", n)
+		}
+	}
+}
+
+// prefixOverlaps reports translation prefixes overlapping each other.
+// Invalid prefixes are skipped, they are reported by prefixRules.
+func (v *validator) prefixOverlaps(defPath, def, rulesPath string, rules []PrefixRule) {
+	type keyed struct {
+		path   string
+		prefix netip.Prefix
+	}
+	var seen []keyed
+	add := func(path, s string) {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return
+		}
+		for _, k := range seen {
+			if k.prefix.Overlaps(prefix) {
+				v.errorf(path, "%s overlaps %s of %s", prefix, k.prefix, k.path)
+			}
+		}
+		seen = append(seen, keyed{path, prefix})
+	}
+	add(defPath, def)
+	for i, r := range rules {
+		add(fmt.Sprintf("%s[%d].prefix", rulesPath, i), r.Prefix)
+	}
+}
+
+// viewPrefixOverlaps checks prefixes effective in the view like viewConfig
+// combines them. Views without own prefixes are checked at the top level.
+func (c *Config) viewPrefixOverlaps(v *validator, path string, view *View) {
+	if view.Prefix == "" && view.Prefixes == nil {
+		return
+	}
+	defPath, def := "prefix", c.Prefix
+	if view.Prefix != "" {
+		defPath, def = path+".prefix", view.Prefix
+	}
+	rulesPath, rules := "prefixes", c.Prefixes
+	if view.Prefixes != nil {
+		rulesPath, rules = path+".prefixes", view.Prefixes
+	} else if view.Prefix != "" {
+		rules = nil
+	}
+	v.prefixOverlaps(defPath, def, rulesPath, rules)
+}
+
+func (v *validator) prefixRules(path string, rules []PrefixRule) {
+	for i, r := range rules {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		if _, err := parsePrefix(r.Prefix); err != nil {
+			v.errorf(p+".prefix", "%s", err)
+		}
+		if len(r.Domains) == 0 && len(r.Networks) == 0 {
+			v.errorf(p, "neither domains nor networks")
+		}
+		for j, d := range r.Domains {
+			if strings.Trim(d, ".") == "" {
+				v.errorf(fmt.Sprintf("%s.domains[%d]", p, j), "empty domain")
+			}
+		}
+		for j, n := range r.Networks {
+			_, ipnet, err := net.ParseCIDR(n)
+			if err != nil || ipnet.IP.To4() == nil {
+				v.errorf(fmt.Sprintf("%s.networks[%d]", p, j), "%q is not an IPv4 CIDR", n)
+			}
+		}
+	}
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+listen: 127.0.0.1:5353
+prefix: "300:dada:feda:f443:ff::"
+default: 192.0.2.53:53
+`
+
+// parseConfig parses configuration text like a file
+func parseConfig(t *testing.T, text string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return parseFile(path)
+}
+
+func TestValidateKeyPaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errors []string
+	}{
+		{"valid", validConfig, nil},
+		{"no default", `
+listen: 127.0.0.1:5353
+prefix: "300:dada:feda:f443:ff::"
+`, []string{"default: required"}},
+		{"forwarder server", validConfig + `
+forwarders:
+  ".corp": [10.0.0.1:53, "10.0.0.2:99999"]
+`, []string{`forwarders[".corp"].servers[1]: "10.0.0.2:99999" has invalid port`}},
+		{"view forwarder server", validConfig + `
+views:
+  - clients: [10.0.0.0/8]
+  - clients: [192.168.0.0/16]
+    forwarders:
+      ".corp":
+        strategy: random
+        servers: ["bad:address:53"]
+`, []string{
+			`views[1].forwarders[".corp"].strategy: "random" must be one of`,
+			`views[1].forwarders[".corp"].servers[0]:`,
+		}},
+		{"view clients", validConfig + `
+views:
+  - name: a
+    clients: [10.0.0.0/8, nonsense]
+  - name: a
+`, []string{
+			`views[0].clients[1]: "nonsense" is not an address or CIDR`,
+			`views[1].name: duplicate view "a"`,
+			`views[1].clients: required`,
+		}},
+		{"duplicate static", validConfig + `
+static:
+  host.ygg: 10.0.0.1
+  Host.ygg.: 10.0.0.2
+`, []string{`static["host.ygg"]: duplicates "Host.ygg."`}},
+		{"prefix rule", validConfig + `
+prefixes:
+  - prefix: 300:1::/33
+    domains: [""]
+`, []string{
+			"prefixes[0].prefix:",
+			"prefixes[0].domains[0]: empty domain",
+		}},
+		{"upstream and ttl", validConfig + `
+upstream:
+  timeout: 0s
+  connections: 0
+ttl:
+  min: 600
+  max: 60
+`, []string{
+			"upstream.timeout: 0s is not positive",
+			"upstream.connections: 0 is less than 1",
+			"ttl.min: 600 is greater than ttl.max 60",
+		}},
+		{"log levels", validConfig + `
+log-levels:
+  cache: loud
+  nothing: debug
+`, []string{
+			"log-levels.cache:",
+			"log-levels.nothing: unknown subsystem",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(t, tt.config)
+			checkErrors(t, err, tt.errors)
+		})
+	}
+}
+
+func TestValidatePrefixOverlaps(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		errors []string
+	}{
+		{"distinct", validConfig + `
+prefixes:
+  - prefix: 300:1::/32
+    domains: [corp]
+  - prefix: 300:2::/32
+    domains: [lan]
+`, nil},
+		{"rule inside default", validConfig + `
+prefixes:
+  - prefix: 300:dada:feda:f443::/64
+    domains: [corp]
+`, []string{"prefixes[0].prefix: 300:dada:feda:f443::/64 overlaps 300:dada:feda:f443:ff::/96 of prefix"}},
+		{"rules overlap", validConfig + `
+prefixes:
+  - prefix: 300:1::/32
+    domains: [corp]
+  - prefix: 300:1:2::/48
+    domains: [lan]
+`, []string{"prefixes[1].prefix: 300:1:2::/48 overlaps 300:1::/32 of prefixes[0].prefix"}},
+		{"view prefix over top rules", validConfig + `
+prefixes:
+  - prefix: 300:1::/32
+    domains: [corp]
+views:
+  - clients: [10.0.0.0/8]
+    prefixes:
+      - prefix: 300:dada:feda:f443:ff::/96
+        domains: [lan]
+`, []string{"views[0].prefixes[0].prefix: 300:dada:feda:f443:ff::/96 overlaps 300:dada:feda:f443:ff::/96 of prefix"}},
+		// View prefix replaces top prefixes, they are not combined
+		{"view own prefix", validConfig + `
+prefixes:
+  - prefix: 300:1::/32
+    domains: [corp]
+views:
+  - clients: [10.0.0.0/8]
+    prefix: "300:1::"
+`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(t, tt.config)
+			checkErrors(t, err, tt.errors)
+		})
+	}
+}
+
+// checkErrors expects every error prefix on its own line of err
+func checkErrors(t *testing.T, err error, want []string) {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("no errors, want %q", want)
+	}
+	lines := strings.Split(err.Error(), "\n")
+	for _, w := range want {
+		found := false
+		for _, l := range lines {
+			found = found || strings.HasPrefix(l, w)
+		}
+		if !found {
+			t.Errorf("no error %q in:\n%s", w, err)
+		}
+	}
+}
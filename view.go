@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type clientView struct {
+	name    string
+	clients []*net.IPNet
+	proxy   *DNSProxy
+}
+
+// Router checks client address against ACL and selects proxy of
+// the first view matching the client.
+type Router struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	views []clientView
+	def   *DNSProxy
+}
+
+func NewRouter(cfg *Config, pool *Pool, logger *Log) (*Router, error) {
+	var err error
+	r := new(Router)
+
+	if r.allow, err = parseNetworks(cfg.ACL.Allow); err != nil {
+		return nil, fmt.Errorf("acl.allow: %w", err)
+	}
+	if r.deny, err = parseNetworks(cfg.ACL.Deny); err != nil {
+		return nil, fmt.Errorf("acl.deny: %w", err)
+	}
+	if r.def, err = NewDNSProxy(cfg, pool, logger); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Views {
+		v := &cfg.Views[i]
+		view := clientView{name: v.Name}
+		if view.name == "" {
+			view.name = fmt.Sprintf("#%d", i)
+		}
+		if view.clients, err = parseNetworks(v.Clients); err != nil {
+			return nil, fmt.Errorf("view %s: %w", view.name, err)
+		}
+		if len(view.clients) == 0 {
+			return nil, fmt.Errorf("view %s: no clients", view.name)
+		}
+		viewCfg := cfg.viewConfig(v)
+		if view.proxy, err = NewDNSProxy(&viewCfg, pool, logger); err != nil {
+			return nil, fmt.Errorf("view %s: %w", view.name, err)
+		}
+		r.views = append(r.views, view)
+	}
+	return r, nil
+}
+
+// Select returns proxy for the client. Nil means the client is refused.
+func (r *Router) Select(ip net.IP) *DNSProxy {
+	if containsIP(r.deny, ip) {
+		return nil
+	}
+	if len(r.allow) > 0 && !containsIP(r.allow, ip) {
+		return nil
+	}
+	for _, v := range r.views {
+		if containsIP(v.clients, ip) {
+			return v.proxy
+		}
+	}
+	return r.def
+}
+
+// parseNetworks parses list of CIDRs. Plain address means single host
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns IP of the client address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}